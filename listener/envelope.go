@@ -0,0 +1,74 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"utils/logging"
+	"utils/messenger"
+	"utils/utils/contextutils"
+	"utils/utils/trackingutils"
+)
+
+// logger fields set from the envelope
+const (
+	trackingFieldName = "tracking_id"
+	originFieldName   = "origin"
+)
+
+// TypedHandler processes the data of a messenger.CommonMessage,
+// already decoded into T. log and ctx carry the message's
+// tracking ID and origin.
+type TypedHandler[T any] func(
+	log *logging.Logger,
+	ctx context.Context,
+	data *T,
+) error
+
+// Envelope adapts handler to messages published through
+// messenger.PublishMessage. for each message, it:
+//   - decodes the CommonMessage, with the codec of its
+//     content type (see messenger.Codec);
+//   - puts its tracking ID (a new one, if missing) and origin
+//     into ctx, under contextutils.ContextKeyReqTracking and
+//     contextutils.ContextKeyReqFrom;
+//   - derives a logger from log with both of them;
+//   - decodes Data into T.
+//
+// messages that can't be decoded fail permanently.
+func Envelope[T any](
+	log *logging.Logger,
+	handler TypedHandler[T],
+) Handler {
+	return func(ctx context.Context, msg messenger.Message) error {
+
+		// decoded according to its content type
+		envelope := messenger.CommonMessage{}
+		err := msg.WriteToModel(&envelope)
+		if err != nil {
+			return Permanent(fmt.Errorf("decoding envelope: %w", err))
+		}
+
+		if envelope.TrackingID == "" {
+			envelope.TrackingID = trackingutils.GlobalTrackingNumber.Next()
+		}
+
+		ctx = contextutils.SetContextValue(
+			ctx, contextutils.ContextKeyReqTracking, envelope.TrackingID)
+		ctx = contextutils.SetContextValue(
+			ctx, contextutils.ContextKeyReqFrom, envelope.Origin)
+
+		l := log.New().
+			SetString(trackingFieldName, envelope.TrackingID).
+			SetString(originFieldName, envelope.Origin)
+
+		data := new(T)
+		err = json.Unmarshal([]byte(envelope.Data), data)
+		if err != nil {
+			l.Error("error decoding data: %v", err)
+			return Permanent(fmt.Errorf("decoding data: %w", err))
+		}
+
+		return handler(l, ctx, data)
+	}
+}
@@ -0,0 +1,163 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+	"utils/utils/contextutils"
+	"utils/utils/testutils"
+)
+
+func TestEnvelope(t *testing.T) {
+
+	l := logging.New()
+
+	type order struct {
+		ID    string `json:"id"`
+		Total int    `json:"total"`
+	}
+
+	// publishes data through messenger.PublishMessage and
+	// returns the message a reader would get
+	publish := func(trackingID string, data any) *fakeMessage {
+		client := &fakeClient{}
+		ctx := contextutils.SetContextValue(context.Background(),
+			contextutils.ContextKeyReqTracking, trackingID)
+
+		err := messenger.PublishMessage(
+			l, ctx, client, "orders-service", "orders", data)
+		testutils.AssertError(t, err, nil)
+
+		return &fakeMessage{payload: []byte(client.sent["orders"][0])}
+	}
+
+	t.Run("decode", func(t *testing.T) {
+
+		var got *order
+		var tracking, origin any
+
+		handler := Envelope(l,
+			func(log *logging.Logger, ctx context.Context, data *order) error {
+				got = data
+				tracking = contextutils.GetContextValue(
+					ctx, contextutils.ContextKeyReqTracking)
+				origin = contextutils.GetContextValue(
+					ctx, contextutils.ContextKeyReqFrom)
+				return nil
+			},
+		)
+
+		msg := publish("track-1", order{ID: "o1", Total: 10})
+
+		err := handler(context.Background(), msg)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertStruct(t, *got, order{ID: "o1", Total: 10})
+		testutils.AssertString(t, tracking.(string), "track-1")
+		testutils.AssertString(t, origin.(string), "orders-service")
+	})
+
+	t.Run("missing tracking id", func(t *testing.T) {
+
+		var tracking any
+
+		handler := Envelope(l,
+			func(log *logging.Logger, ctx context.Context, data *order) error {
+				tracking = contextutils.GetContextValue(
+					ctx, contextutils.ContextKeyReqTracking)
+				return nil
+			},
+		)
+
+		err := handler(context.Background(), publish("", order{ID: "o1"}))
+		testutils.AssertError(t, err, nil)
+		testutils.AssertBool(t, tracking.(string) != "", true)
+	})
+
+	t.Run("handler error", func(t *testing.T) {
+
+		errRetry := errors.New("try again")
+
+		handler := Envelope(l,
+			func(log *logging.Logger, ctx context.Context, data *order) error {
+				return errRetry
+			},
+		)
+
+		err := handler(context.Background(), publish("t", order{}))
+		testutils.AssertError(t, err, errRetry)
+	})
+
+	t.Run("bad messages", func(t *testing.T) {
+
+		handler := Envelope(l,
+			func(log *logging.Logger, ctx context.Context, data *order) error {
+				return nil
+			},
+		)
+
+		err := handler(context.Background(),
+			&fakeMessage{payload: []byte(`not json`)})
+		testutils.AssertBool(t, errors.Is(err, ErrPermanent), true)
+
+		err = handler(context.Background(),
+			&fakeMessage{payload: []byte(`{"data":"not json"}`)})
+		testutils.AssertBool(t, errors.Is(err, ErrPermanent), true)
+
+		err = handler(context.Background(), publish("t", "not an order"))
+		testutils.AssertBool(t, errors.Is(err, ErrPermanent), true)
+	})
+
+	t.Run("content type", func(t *testing.T) {
+
+		codec, err := messenger.NewAvroCodec(`{
+			"type": "record",
+			"name": "common_message",
+			"fields": [
+				{"name": "tracking_id", "type": "string"},
+				{"name": "origin", "type": "string"},
+				{"name": "creation_date_time", "type": "string"},
+				{"name": "data", "type": "string"}
+			]
+		}`)
+		testutils.AssertError(t, err, nil)
+
+		client := messenger.NewClientRAM(time.Millisecond)
+		defer client.Close()
+		client.SetTopicCodec("orders", codec)
+
+		reader, err := client.NewReader(
+			"orders", "inbox", messenger.SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		ctx := contextutils.SetContextValue(context.Background(),
+			contextutils.ContextKeyReqTracking, "track-1")
+		err = messenger.PublishMessage(
+			l, ctx, client, "orders-service", "orders", order{ID: "o1"})
+		testutils.AssertError(t, err, nil)
+
+		msg, err := reader.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t,
+			msg.Properties()[messenger.ContentTypeProperty],
+			messenger.ContentTypeAvro)
+
+		var got *order
+		var tracking any
+
+		handler := Envelope(l,
+			func(log *logging.Logger, ctx context.Context, data *order) error {
+				got = data
+				tracking = contextutils.GetContextValue(
+					ctx, contextutils.ContextKeyReqTracking)
+				return nil
+			},
+		)
+
+		testutils.AssertError(t, handler(context.Background(), msg), nil)
+		testutils.AssertStruct(t, *got, order{ID: "o1"})
+		testutils.AssertString(t, tracking.(string), "track-1")
+	})
+}
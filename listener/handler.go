@@ -0,0 +1,125 @@
+package listener
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"utils/logging"
+	"utils/messenger"
+	"utils/workerpool"
+)
+
+// how many times a message is given back because it could
+// not be sent to the dead letter topic, before being dropped
+const maxDeadLetterRetries = 5
+
+var ErrPermanent = errors.New("permanent failure")
+
+// Handler processes a single message. the listener acks it
+// when Handler returns nil and nacks it, so it is delivered
+// again, otherwise. errors wrapping ErrPermanent (see Permanent)
+// are not retried: the message goes to the dead letter topic.
+type Handler func(ctx context.Context, msg messenger.Message) error
+
+// Permanent marks err as not worth retrying
+func Permanent(err error) error {
+	return fmt.Errorf("%w: %w", ErrPermanent, err)
+}
+
+// NewHandlerListener creates a BrokerListener that calls
+// handler for each message and acks or nacks it according
+// to its result.
+func NewHandlerListener(
+	messenger messenger.Client,
+	topic string,
+	inbox string,
+	numOfWorkers uint,
+	handler Handler,
+) *BrokerListener {
+	bl := NewBrokerListener(messenger, topic, inbox, numOfWorkers, nil)
+	bl.handler = handler
+	return bl
+}
+
+// SetDeadLetter sets the topic permanently failed messages
+// are sent to. if empty (default), they are logged and dropped.
+// must be called before Listen.
+func (bl *BrokerListener) SetDeadLetter(topic string) {
+	bl.deadLetter = topic
+}
+
+// handlerWorker adapts the handler to a worker. ctx is handed
+// to the handler; it should not be canceled while the pool drains.
+func (bl *BrokerListener) handlerWorker(
+	ctx context.Context,
+) workerpool.WorkerFunc {
+	return func(log *logging.Logger, id string, in chan any) {
+		for p := range in {
+			bl.handle(log, ctx, p.(messenger.Message))
+		}
+	}
+}
+
+func (bl *BrokerListener) handle(
+	log *logging.Logger,
+	ctx context.Context,
+	msg messenger.Message,
+) {
+	l := log.New()
+
+	err := bl.handler(ctx, msg)
+
+	switch {
+	case err == nil:
+		msg.Received()
+
+	case errors.Is(err, ErrPermanent):
+		l.Error("message from topic %q failed permanently: %v",
+			bl.topic, err)
+		bl.sendToDeadLetter(l, msg)
+
+	default:
+		l.Debug("message from topic %q will be retried: %v",
+			bl.topic, err)
+		msg.GiveBack()
+	}
+}
+
+func (bl *BrokerListener) sendToDeadLetter(
+	log *logging.Logger,
+	msg messenger.Message,
+) {
+	l := log.New()
+
+	if bl.deadLetter == "" {
+		l.Warn("no dead letter topic set. dropping message.")
+		msg.Received()
+		return
+	}
+
+	// forwarded as is: it may not even be decodable
+	err := bl.messenger.SendRaw(bl.deadLetter, msg.Payload(),
+		messenger.SendOptions{
+			Key:        msg.Key(),
+			Properties: msg.Properties(),
+			EventTime:  msg.EventTime(),
+		},
+	)
+	if err != nil {
+		l.Error("error sending message to dead letter topic %q: %v",
+			bl.deadLetter, err)
+
+		if msg.RedeliveryCount() < maxDeadLetterRetries {
+			// it will be delivered (and fail) again
+			msg.GiveBack()
+			return
+		}
+
+		l.Error("giving up on message %v after %v attempts. dropping it.",
+			msg.ID(), maxDeadLetterRetries+1)
+		msg.Received()
+		return
+	}
+
+	msg.Received()
+}
@@ -0,0 +1,84 @@
+package listener
+
+import (
+	"time"
+)
+
+type State int
+
+const (
+	// not listening: Listen was not called yet or returned
+	StateStopped State = iota
+	// setting up the first reader
+	StateConnecting
+	// reading messages
+	StateListening
+	// the reader was lost and is being set up again
+	StateReconnecting
+)
+
+func (s State) String() string {
+	switch s {
+	case StateStopped:
+		return "stopped"
+	case StateConnecting:
+		return "connecting"
+	case StateListening:
+		return "listening"
+	case StateReconnecting:
+		return "reconnecting"
+	}
+	return "unknown"
+}
+
+// Health is a point in time view of a BrokerListener's
+// connection to the broker.
+type Health struct {
+	State State
+	// when State was entered
+	Since time.Time
+	// last error getting a reader or reading from it.
+	// nil if none since the last successful connection.
+	LastError error
+	// how many times the reader was set up again
+	Reconnects int
+}
+
+// Healthy reports whether the listener is reading messages
+func (h Health) Healthy() bool {
+	return h.State == StateListening
+}
+
+// Health returns the current connection state of the listener.
+// it can be exposed, for example, by a health check endpoint.
+func (bl *BrokerListener) Health() Health {
+	bl.healthMutex.Lock()
+	defer bl.healthMutex.Unlock()
+
+	return bl.health
+}
+
+func (bl *BrokerListener) setState(state State, err error) {
+	bl.healthMutex.Lock()
+	defer bl.healthMutex.Unlock()
+
+	if state == StateReconnecting &&
+		bl.health.State == StateListening {
+		bl.health.Reconnects++
+	}
+
+	if state != bl.health.State {
+		bl.health.State = state
+		bl.health.Since = time.Now()
+	}
+
+	bl.health.LastError = err
+}
+
+// setError records err without changing the state
+func (bl *BrokerListener) setError(err error) {
+	bl.healthMutex.Lock()
+	defer bl.healthMutex.Unlock()
+
+	bl.health.LastError = err
+}
@@ -1,20 +1,61 @@
 package listener
 
 import (
+	"context"
+	"sync"
 	"time"
 	"utils/logging"
 	"utils/messenger"
 	"utils/workerpool"
 )
 
+// how long each Peek waits for a message. it bounds how
+// long Listen takes to notice its context is done.
+const peekTimeout = 1 * time.Second
+
+// reconnection defaults. see SetReconnect.
+const (
+	defaultMinBackoff = 1 * time.Second
+	defaultMaxBackoff = 1 * time.Minute
+	defaultMaxErrors  = 5
+)
+
+// how long Listen waits for the workers by default.
+// see SetDrainTimeout.
+const defaultDrainTimeout = 30 * time.Second
+
 type BrokerListener struct {
 	topic        string
 	inbox        string
 	numOfWorkers uint
 	worker       workerpool.WorkerFunc
 	messenger    messenger.Client
+
+	// set by NewHandlerListener. see handler.go.
+	handler    Handler
+	deadLetter string
+
+	// reconnection. see SetReconnect.
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	maxErrors  int
+
+	// see SetDrainTimeout
+	drainTimeout time.Duration
+
+	// see health.go
+	healthMutex *sync.Mutex
+	health      Health
 }
 
+// NewBrokerListener creates a listener that feeds messages
+// from topic to a pool of numOfWorkers running worker.
+// worker must return once its channel is closed (e.g. by
+// ranging over it), so Listen can stop: one that reads it in
+// an endless loop gets nil once it is closed, and is only
+// taken as finished if it panics on it. Listen doesn't wait
+// for workers longer than the drain timeout anyway
+// (see SetDrainTimeout).
 func NewBrokerListener(
 	messenger messenger.Client,
 	topic string,
@@ -28,50 +69,243 @@ func NewBrokerListener(
 		messenger:    messenger,
 		numOfWorkers: numOfWorkers,
 		worker:       worker,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		maxErrors:    defaultMaxErrors,
+		drainTimeout: defaultDrainTimeout,
+		healthMutex:  &sync.Mutex{},
 	}
 }
 
-func (bl *BrokerListener) Listen(log *logging.Logger) {
+// SetReconnect sets how the listener recovers from broker
+// errors. it waits minBackoff after the first failed attempt
+// to get a reader, doubling it on each new failure up to
+// maxBackoff. the same applies to errors reading messages;
+// after maxErrors of them in a row, the reader is set up again.
+// must be called before Listen.
+func (bl *BrokerListener) SetReconnect(
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	maxErrors int,
+) {
+	bl.minBackoff = minBackoff
+	bl.maxBackoff = max(minBackoff, maxBackoff)
+	bl.maxErrors = max(1, maxErrors)
+}
+
+// SetDrainTimeout sets how long Listen waits for the workers
+// to finish the messages they took once ctx is done. the
+// reader is closed after that even if they didn't: their
+// messages are delivered again. 0 waits for as long as needed.
+// must be called before Listen.
+func (bl *BrokerListener) SetDrainTimeout(d time.Duration) {
+	bl.drainTimeout = d
+}
+
+// Listen feeds the worker pool with messages from the topic
+// until ctx is done. it then stops pulling messages, waits
+// for the workers to finish the ones they took (see
+// SetDrainTimeout) and closes the reader. if the broker is unavailable, it keeps trying
+// to reconnect (see SetReconnect).
+func (bl *BrokerListener) Listen(
+	log *logging.Logger,
+	ctx context.Context,
+) {
 	l := log.New()
-	var reader messenger.Reader
-	var err error
+
+	worker := bl.worker
+	if bl.handler != nil {
+		// in flight messages must finish after ctx is done
+		worker = bl.handlerWorker(context.WithoutCancel(ctx))
+	}
+
+	wp := workerpool.New(bl.numOfWorkers, worker)
+	wp.Start(l)
+
+	reader := bl.listen(l, ctx, wp.FeedContext)
+
+	drain(l, wp, bl.drainTimeout)
+	bl.close(l, reader)
+}
+
+// drain stops wp, waiting up to timeout (0 = no limit) for
+// its workers to finish.
+func drain(
+	log *logging.Logger,
+	wp *workerpool.WorkersPool,
+	timeout time.Duration,
+) {
+	l := log.New()
+
+	l.Info("Stopping. Waiting for workers to finish.")
+
+	ctx := context.Background()
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	err := wp.Stop(ctx)
+	if err != nil {
+		l.Warn("Workers did not finish in %v. Stopping anyway.",
+			timeout)
+	}
+}
+
+// listen reads messages from the topic and hands them to feed
+// until ctx is done. it returns the reader still open, if any,
+// so it is closed only after the workers are done with it.
+func (bl *BrokerListener) listen(
+	log *logging.Logger,
+	ctx context.Context,
+	feed func(ctx context.Context, msg any) error,
+) messenger.Reader {
+	l := log.New()
+
+	bl.setState(StateConnecting, nil)
 
 	for {
-		reader, err = bl.messenger.NewReader(
+		reader := bl.connect(l, ctx)
+		if reader == nil {
+			return nil
+		}
+
+		l.Info("Now listening to topic %q.", bl.topic)
+
+		if !bl.consume(l, ctx, reader, feed) {
+			return reader
+		}
+
+		// the inbox is kept, so nothing sent meanwhile is lost.
+		// messages still in the workers can't be acked through
+		// this reader anymore: they go back to the inbox and
+		// are delivered again.
+		l.Warn("Too many errors reading from topic %q. Reconnecting.",
+			bl.topic)
+		reader.Disconnect(l)
+	}
+}
+
+// close disconnects the reader returned by listen, if any.
+// the inbox is kept, so messages sent until the next Listen
+// are not lost.
+func (bl *BrokerListener) close(
+	log *logging.Logger,
+	reader messenger.Reader,
+) {
+	l := log.New()
+
+	if reader != nil {
+		reader.Disconnect(l)
+	}
+
+	bl.setState(StateStopped, nil)
+	l.Info("Stopped listening to topic %q.", bl.topic)
+}
+
+// connect gets a new reader, retrying with backoff.
+// returns nil if ctx is done first.
+func (bl *BrokerListener) connect(
+	log *logging.Logger,
+	ctx context.Context,
+) messenger.Reader {
+	l := log.New()
+
+	for attempt := 0; ; attempt++ {
+		reader, err := bl.messenger.NewReader(
 			bl.topic,
 			bl.inbox,
 			messenger.SharedInbox,
 			true,
 		)
-		if err != nil {
-			l.Error("Error setting up messenger: %v", err)
-			l.Error("Will try again soon.")
-			time.Sleep(5 * time.Second)
-			continue
+		if err == nil {
+			bl.setState(StateListening, nil)
+			return reader
 		}
 
-		break
-	}
+		bl.setError(err)
 
-	wp := workerpool.New(bl.numOfWorkers, bl.worker)
-	wp.Start(l)
+		delay := bl.backoff(attempt)
+		l.Error("Error setting up messenger: %v", err)
+		l.Error("Will try again in %v.", delay)
 
-	defer reader.Close(l)
+		if !sleep(ctx, delay) {
+			return nil
+		}
+	}
+}
 
-	l.Info("Now listening to topic %q.", bl.topic)
+// consume hands messages from reader to feed.
+// returns true if the reader must be set up again, or false
+// if ctx is done.
+func (bl *BrokerListener) consume(
+	log *logging.Logger,
+	ctx context.Context,
+	reader messenger.Reader,
+	feed func(ctx context.Context, msg any) error,
+) bool {
+	l := log.New()
+	errs := 0
 
-	for {
+	for ctx.Err() == nil {
 		// Get the mensagem
-		brokerMsg, err := reader.Peek(2 * time.Minute)
+		brokerMsg, err := reader.Peek(peekTimeout)
 		if err != nil {
-			_, isTimeout := err.(*messenger.TimeoutError)
-			if !isTimeout {
-				l.Debug("Error getting message from router: %v", err)
-				brokerMsg.GiveBack()
+			if _, isTimeout := err.(*messenger.TimeoutError); isTimeout {
+				errs = 0
+				continue
+			}
+
+			l.Debug("Error getting message from router: %v", err)
+
+			errs++
+			if errs >= bl.maxErrors {
+				bl.setState(StateReconnecting, err)
+				return true
+			}
+
+			if !sleep(ctx, bl.backoff(errs-1)) {
+				return false
 			}
 
 			continue
 		}
-		wp.Feed(brokerMsg)
+
+		errs = 0
+
+		err = feed(ctx, brokerMsg)
+		if err != nil {
+			// stopping: nobody will process it
+			brokerMsg.GiveBack()
+		}
+	}
+
+	return false
+}
+
+// backoff returns how long to wait after the given
+// failed attempt, counting from 0.
+func (bl *BrokerListener) backoff(attempt int) time.Duration {
+	delay := bl.minBackoff
+	for range attempt {
+		if delay >= bl.maxBackoff {
+			break
+		}
+		delay *= 2
+	}
+	return min(delay, bl.maxBackoff)
+}
+
+// sleep waits for d. returns false if ctx is done first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
 	}
 }
@@ -0,0 +1,774 @@
+package listener
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+	"utils/utils/testutils"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+type fakeMessage struct {
+	payload      []byte
+	properties   map[string]string
+	redeliveries uint32
+	received     atomic.Bool
+	givenBack    atomic.Bool
+}
+
+func (m *fakeMessage) WriteToModel(model any) error {
+	return json.Unmarshal(m.payload, model)
+}
+
+func (m *fakeMessage) Payload() []byte               { return m.payload }
+func (m *fakeMessage) ID() string                    { return "" }
+func (m *fakeMessage) Key() string                   { return "" }
+func (m *fakeMessage) Properties() map[string]string { return m.properties }
+func (m *fakeMessage) EventTime() time.Time          { return time.Time{} }
+func (m *fakeMessage) PublishTime() time.Time        { return time.Time{} }
+func (m *fakeMessage) RedeliveryCount() uint32       { return m.redeliveries }
+func (m *fakeMessage) Received()                     { m.received.Store(true) }
+func (m *fakeMessage) GiveBack()                     { m.givenBack.Store(true) }
+
+type fakeReader struct {
+	msgs chan messenger.Message
+	// returned by Peek instead of messages, if set
+	peekErr error
+	closed  atomic.Bool
+}
+
+func (r *fakeReader) Get(model any, timeout time.Duration) error {
+	return nil
+}
+
+func (r *fakeReader) Peek(
+	timeout time.Duration,
+) (
+	messenger.Message,
+	error,
+) {
+	if r.peekErr != nil {
+		return nil, r.peekErr
+	}
+
+	select {
+	case msg := <-r.msgs:
+		return msg, nil
+	case <-time.After(timeout):
+		return nil, &messenger.TimeoutError{}
+	}
+}
+
+func (r *fakeReader) Close(log *logging.Logger) {
+	r.closed.Store(true)
+}
+
+func (r *fakeReader) Disconnect(log *logging.Logger) {
+	r.closed.Store(true)
+}
+
+type fakeClient struct {
+	reader *fakeReader
+	// used by NewReader instead of reader, if set
+	newReader func(from string) (messenger.Reader, error)
+	mutex     sync.Mutex
+	sent      map[string][]string
+	sendErr   error
+}
+
+func (c *fakeClient) NewReader(
+	from string,
+	inboxName string,
+	inboxType messenger.InboxType,
+	ignorePreviousMessages bool,
+) (
+	messenger.Reader,
+	error,
+) {
+	if c.newReader != nil {
+		return c.newReader(from)
+	}
+	return c.reader, nil
+}
+
+func (c *fakeClient) Send(to string, model any) error {
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+
+	b, err := json.Marshal(model)
+	if err != nil {
+		return err
+	}
+
+	return c.SendRaw(to, b, messenger.SendOptions{})
+}
+
+func (c *fakeClient) SendRaw(
+	to string,
+	payload []byte,
+	opts messenger.SendOptions,
+) error {
+	if c.sendErr != nil {
+		return c.sendErr
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.sent == nil {
+		c.sent = map[string][]string{}
+	}
+	c.sent[to] = append(c.sent[to], string(payload))
+
+	return nil
+}
+
+func (c *fakeClient) SendWithOptions(
+	to string,
+	model any,
+	opts messenger.SendOptions,
+) error {
+	return c.Send(to, model)
+}
+
+func (c *fakeClient) SendAsync(to string, model any, callback func(err error)) {
+	err := c.Send(to, model)
+	if callback != nil {
+		callback(err)
+	}
+}
+
+func (c *fakeClient) Close() {}
+
+func TestBrokerListener(t *testing.T) {
+
+	l := logging.New()
+
+	t.Run("stops and drains", func(t *testing.T) {
+
+		reader := &fakeReader{
+			msgs: make(chan messenger.Message, 10),
+		}
+
+		var processed atomic.Int32
+
+		bl := NewBrokerListener(
+			&fakeClient{reader: reader}, "topic", "inbox", 2,
+			func(log *logging.Logger, id string, in chan any) {
+				for p := range in {
+					time.Sleep(50 * time.Millisecond)
+					p.(messenger.Message).Received()
+					processed.Add(1)
+				}
+			},
+		)
+
+		msgs := []*fakeMessage{{}, {}}
+		for _, m := range msgs {
+			reader.msgs <- m
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		// both taken by workers, none finished yet
+		for len(reader.msgs) > 0 {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listen did not return")
+		}
+
+		testutils.AssertInt(t, int(processed.Load()), 2)
+		testutils.AssertBool(t, reader.closed.Load(), true)
+		for _, m := range msgs {
+			testutils.AssertBool(t, m.received.Load(), true)
+		}
+
+	})
+
+	t.Run("worker not ranging over in", func(t *testing.T) {
+
+		reader := &fakeReader{
+			msgs: make(chan messenger.Message, 10),
+		}
+
+		bl := NewBrokerListener(
+			&fakeClient{reader: reader}, "topic", "inbox", 2,
+			func(log *logging.Logger, id string, in chan any) {
+				for {
+					m := (<-in).(messenger.Message)
+					m.Received()
+				}
+			},
+		)
+
+		msg := &fakeMessage{}
+		reader.msgs <- msg
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		for !msg.received.Load() {
+			time.Sleep(time.Millisecond)
+		}
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listen did not return")
+		}
+
+		testutils.AssertBool(t, reader.closed.Load(), true)
+
+	})
+
+	t.Run("drain timeout", func(t *testing.T) {
+
+		reader := &fakeReader{
+			msgs: make(chan messenger.Message, 10),
+		}
+
+		taken := make(chan struct{})
+		release := make(chan struct{})
+		defer close(release)
+
+		bl := NewBrokerListener(
+			&fakeClient{reader: reader}, "topic", "inbox", 1,
+			func(log *logging.Logger, id string, in chan any) {
+				for range in {
+					close(taken)
+					<-release
+				}
+			},
+		)
+		bl.SetDrainTimeout(50 * time.Millisecond)
+
+		reader.msgs <- &fakeMessage{}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		<-taken
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listen did not return")
+		}
+
+		// closed even if the worker didn't finish
+		testutils.AssertBool(t, reader.closed.Load(), true)
+
+	})
+
+	t.Run("restart keeps inbox", func(t *testing.T) {
+
+		client := messenger.NewClientRAM(time.Millisecond)
+		defer client.Close()
+
+		got := make(chan string, 10)
+
+		bl := NewHandlerListener(client, "topic", "inbox", 1,
+			func(ctx context.Context, msg messenger.Message) error {
+				got <- string(msg.Payload())
+				return nil
+			},
+		)
+
+		listen := func() (stop func()) {
+			ctx, cancel := context.WithCancel(context.Background())
+			done := make(chan struct{})
+			go func() {
+				bl.Listen(l, ctx)
+				close(done)
+			}()
+			for !bl.Health().Healthy() {
+				time.Sleep(time.Millisecond)
+			}
+			return func() {
+				cancel()
+				<-done
+			}
+		}
+
+		stop := listen()
+		testutils.AssertError(t, client.Send("topic", 1), nil)
+		testutils.AssertString(t, <-got, "1")
+		stop()
+
+		// sent while nobody listens
+		testutils.AssertError(t, client.Send("topic", 2), nil)
+
+		stop = listen()
+		defer stop()
+
+		select {
+		case p := <-got:
+			testutils.AssertString(t, p, "2")
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message sent between runs was lost")
+		}
+	})
+}
+
+func TestHandlerListener(t *testing.T) {
+
+	l := logging.New()
+
+	// feeds msgs to a handler listener and returns once
+	// they were all processed
+	listen := func(
+		client *fakeClient,
+		deadLetter string,
+		msgs []*fakeMessage,
+		handler Handler,
+	) {
+		client.reader = &fakeReader{
+			msgs: make(chan messenger.Message, len(msgs)),
+		}
+
+		var wg sync.WaitGroup
+		wg.Add(len(msgs))
+
+		bl := NewHandlerListener(client, "topic", "inbox", 2,
+			func(ctx context.Context, msg messenger.Message) error {
+				defer wg.Done()
+				return handler(ctx, msg)
+			},
+		)
+		bl.SetDeadLetter(deadLetter)
+
+		for _, m := range msgs {
+			client.reader.msgs <- m
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		wg.Wait()
+		cancel()
+		<-done
+	}
+
+	t.Run("ack and nack", func(t *testing.T) {
+
+		ok := &fakeMessage{payload: []byte(`"ok"`)}
+		fail := &fakeMessage{payload: []byte(`"fail"`)}
+
+		listen(&fakeClient{}, "dead", []*fakeMessage{ok, fail},
+			func(ctx context.Context, msg messenger.Message) error {
+				if string(msg.Payload()) == `"fail"` {
+					return errors.New("try again")
+				}
+				return nil
+			},
+		)
+
+		testutils.AssertBool(t, ok.received.Load(), true)
+		testutils.AssertBool(t, ok.givenBack.Load(), false)
+		testutils.AssertBool(t, fail.received.Load(), false)
+		testutils.AssertBool(t, fail.givenBack.Load(), true)
+	})
+
+	t.Run("dead letter", func(t *testing.T) {
+
+		client := &fakeClient{}
+		msg := &fakeMessage{payload: []byte(`{"a":1}`)}
+
+		listen(client, "dead", []*fakeMessage{msg},
+			func(ctx context.Context, msg messenger.Message) error {
+				return Permanent(errors.New("bad message"))
+			},
+		)
+
+		testutils.AssertBool(t, msg.received.Load(), true)
+		testutils.AssertBool(t, msg.givenBack.Load(), false)
+		testutils.AssertInt(t, len(client.sent["dead"]), 1)
+		testutils.AssertString(t, client.sent["dead"][0], `{"a":1}`)
+	})
+
+	t.Run("dead letter send error", func(t *testing.T) {
+
+		client := &fakeClient{sendErr: errors.New("broker down")}
+		msg := &fakeMessage{payload: []byte(`{"a":1}`)}
+
+		listen(client, "dead", []*fakeMessage{msg},
+			func(ctx context.Context, msg messenger.Message) error {
+				return Permanent(errors.New("bad message"))
+			},
+		)
+
+		testutils.AssertBool(t, msg.received.Load(), false)
+		testutils.AssertBool(t, msg.givenBack.Load(), true)
+	})
+
+	t.Run("dead letter gives up", func(t *testing.T) {
+
+		client := &fakeClient{sendErr: errors.New("broker down")}
+		msg := &fakeMessage{
+			payload:      []byte(`{"a":1}`),
+			redeliveries: maxDeadLetterRetries,
+		}
+
+		listen(client, "dead", []*fakeMessage{msg},
+			func(ctx context.Context, msg messenger.Message) error {
+				return Permanent(errors.New("bad message"))
+			},
+		)
+
+		testutils.AssertBool(t, msg.received.Load(), true)
+		testutils.AssertBool(t, msg.givenBack.Load(), false)
+	})
+
+	t.Run("dead letter not json", func(t *testing.T) {
+
+		client := &fakeClient{}
+		msg := &fakeMessage{payload: []byte("not json")}
+
+		type model struct{}
+
+		listen(client, "dead", []*fakeMessage{msg},
+			Envelope(l,
+				func(log *logging.Logger, ctx context.Context, data *model) error {
+					return nil
+				},
+			),
+		)
+
+		testutils.AssertBool(t, msg.received.Load(), true)
+		testutils.AssertBool(t, msg.givenBack.Load(), false)
+		testutils.AssertInt(t, len(client.sent["dead"]), 1)
+		testutils.AssertString(t, client.sent["dead"][0], "not json")
+	})
+
+	t.Run("dead letter keeps content type", func(t *testing.T) {
+
+		client := messenger.NewClientRAM(time.Millisecond)
+		defer client.Close()
+		client.SetTopicCodec("topic", messenger.ProtobufCodec{})
+
+		dead, err := client.NewReader(
+			"dead", "inbox", messenger.SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		processed := make(chan struct{})
+
+		bl := NewHandlerListener(client, "topic", "inbox", 1,
+			func(ctx context.Context, msg messenger.Message) error {
+				defer close(processed)
+				return Permanent(errors.New("bad message"))
+			},
+		)
+		bl.SetDeadLetter("dead")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		for !bl.Health().Healthy() {
+			time.Sleep(time.Millisecond)
+		}
+
+		err = client.Send("topic", wrapperspb.String("baba"))
+		testutils.AssertError(t, err, nil)
+
+		<-processed
+		cancel()
+		<-done
+
+		msg, err := dead.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t,
+			msg.Properties()[messenger.ContentTypeProperty],
+			messenger.ContentTypeProtobuf)
+
+		// nothing tells the reader of "dead" about protobuf
+		got := &wrapperspb.StringValue{}
+		testutils.AssertError(t, msg.WriteToModel(got), nil)
+		testutils.AssertString(t, got.GetValue(), "baba")
+
+		// only once
+		_, err = dead.Peek(20 * time.Millisecond)
+		_, isTimeout := err.(*messenger.TimeoutError)
+		testutils.AssertBool(t, isTimeout, true)
+	})
+
+	t.Run("no dead letter", func(t *testing.T) {
+
+		client := &fakeClient{}
+		msg := &fakeMessage{payload: []byte(`{"a":1}`)}
+
+		listen(client, "", []*fakeMessage{msg},
+			func(ctx context.Context, msg messenger.Message) error {
+				return Permanent(errors.New("bad message"))
+			},
+		)
+
+		testutils.AssertBool(t, msg.received.Load(), true)
+		testutils.AssertInt(t, len(client.sent), 0)
+	})
+}
+
+// breakingReader fails every Peek after the first message,
+// closing broken when it starts failing
+type breakingReader struct {
+	messenger.Reader
+	broken chan struct{}
+	read   atomic.Bool
+}
+
+func (r *breakingReader) Peek(
+	timeout time.Duration,
+) (
+	messenger.Message,
+	error,
+) {
+	if r.read.Load() {
+		return nil, errors.New("connection lost")
+	}
+
+	msg, err := r.Reader.Peek(timeout)
+	if err == nil {
+		r.read.Store(true)
+		close(r.broken)
+	}
+	return msg, err
+}
+
+// acks every message
+func ack(log *logging.Logger, id string, in chan any) {
+	for p := range in {
+		p.(messenger.Message).Received()
+	}
+}
+
+func TestReconnect(t *testing.T) {
+
+	l := logging.New()
+
+	t.Run("backoff", func(t *testing.T) {
+
+		bl := NewBrokerListener(&fakeClient{}, "topic", "inbox", 1, ack)
+		bl.SetReconnect(time.Second, 10*time.Second, 3)
+
+		want := []time.Duration{1, 2, 4, 8, 10, 10}
+		for i, w := range want {
+			testutils.AssertInt(t, int(bl.backoff(i)), int(w*time.Second))
+		}
+	})
+
+	t.Run("reconnect", func(t *testing.T) {
+
+		good := &fakeReader{msgs: make(chan messenger.Message, 1)}
+		bad := &fakeReader{peekErr: errors.New("connection lost")}
+
+		var calls atomic.Int32
+
+		// fails, gives a broken reader, fails, then a good one
+		client := &fakeClient{
+			newReader: func(from string) (messenger.Reader, error) {
+				switch calls.Add(1) {
+				case 1, 3:
+					return nil, errors.New("broker down")
+				case 2:
+					return bad, nil
+				}
+				return good, nil
+			},
+		}
+
+		processed := make(chan struct{})
+
+		bl := NewHandlerListener(client, "topic", "inbox", 1,
+			func(ctx context.Context, msg messenger.Message) error {
+				close(processed)
+				return nil
+			},
+		)
+		bl.SetReconnect(time.Millisecond, 5*time.Millisecond, 3)
+
+		testutils.AssertString(t, bl.Health().State.String(), "stopped")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		msg := &fakeMessage{}
+		good.msgs <- msg
+
+		select {
+		case <-processed:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("message not processed")
+		}
+
+		h := bl.Health()
+		testutils.AssertBool(t, h.Healthy(), true)
+		testutils.AssertInt(t, h.Reconnects, 1)
+		testutils.AssertBool(t, h.LastError == nil, true)
+		testutils.AssertInt(t, int(calls.Load()), 4)
+		testutils.AssertBool(t, bad.closed.Load(), true)
+		testutils.AssertBool(t, good.closed.Load(), false)
+
+		cancel()
+		<-done
+
+		testutils.AssertBool(t, good.closed.Load(), true)
+		testutils.AssertBool(t, msg.received.Load(), true)
+		testutils.AssertString(t, bl.Health().State.String(), "stopped")
+	})
+
+	t.Run("messages survive reconnect", func(t *testing.T) {
+
+		client := messenger.NewClientRAM(time.Millisecond)
+		defer client.Close()
+
+		var calls atomic.Int32
+		broken := make(chan struct{})
+
+		// the first reader breaks once it has handed out a message
+		wrapper := &fakeClient{
+			newReader: func(from string) (messenger.Reader, error) {
+				r, err := client.NewReader(
+					from, "inbox", messenger.SharedInbox, true)
+				if err != nil || calls.Add(1) > 1 {
+					return r, err
+				}
+				return &breakingReader{Reader: r, broken: broken}, nil
+			},
+		}
+
+		// key: payload
+		mutex := &sync.Mutex{}
+		got := map[string]int{}
+		acked := make(chan string, 10)
+
+		bl := NewHandlerListener(wrapper, "topic", "inbox", 1,
+			func(ctx context.Context, msg messenger.Message) error {
+				p := string(msg.Payload())
+
+				mutex.Lock()
+				got[p]++
+				first := got[p] == 1
+				mutex.Unlock()
+
+				if p == "1" && first {
+					// still in the worker while the reader is replaced
+					<-broken
+					time.Sleep(20 * time.Millisecond)
+				}
+
+				acked <- p
+				return nil
+			},
+		)
+		bl.SetReconnect(time.Millisecond, 5*time.Millisecond, 3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+		defer func() {
+			cancel()
+			<-done
+		}()
+
+		for !bl.Health().Healthy() {
+			time.Sleep(time.Millisecond)
+		}
+
+		testutils.AssertError(t, client.Send("topic", 1), nil)
+
+		<-broken
+		// sent while reconnecting
+		testutils.AssertError(t, client.Send("topic", 2), nil)
+
+		// "1" is handled twice: its ack through the broken reader is lost
+		want := map[string]bool{"1": true, "2": true}
+		for len(want) > 0 {
+			select {
+			case p := <-acked:
+				delete(want, p)
+			case <-time.After(5 * time.Second):
+				t.Fatalf("messages lost on reconnect: %v", want)
+			}
+		}
+
+		testutils.AssertInt(t, bl.Health().Reconnects, 1)
+	})
+
+	t.Run("stops while connecting", func(t *testing.T) {
+
+		client := &fakeClient{
+			newReader: func(from string) (messenger.Reader, error) {
+				return nil, errors.New("broker down")
+			},
+		}
+
+		bl := NewBrokerListener(client, "topic", "inbox", 1, ack)
+		bl.SetReconnect(time.Millisecond, 5*time.Millisecond, 3)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			bl.Listen(l, ctx)
+			close(done)
+		}()
+
+		for bl.Health().LastError == nil {
+			time.Sleep(time.Millisecond)
+		}
+		testutils.AssertString(t, bl.Health().State.String(), "connecting")
+		testutils.AssertBool(t, bl.Health().Healthy(), false)
+
+		cancel()
+
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Listen did not return")
+		}
+	})
+}
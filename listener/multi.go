@@ -0,0 +1,217 @@
+package listener
+
+import (
+	"context"
+	"sync"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+	"utils/workerpool"
+)
+
+// MultiListener listens to several topics, given by name,
+// routing each message to the handler of its topic. all
+// topics share one worker pool.
+type MultiListener struct {
+	inbox        string
+	numOfWorkers uint
+	messenger    messenger.Client
+	deadLetter   string
+	minBackoff   time.Duration
+	maxBackoff   time.Duration
+	maxErrors    int
+	drainTimeout time.Duration
+
+	// in the order they were added
+	routes []*route
+}
+
+type route struct {
+	// reads the topic. its pool is not used.
+	listener *BrokerListener
+	// limits messages of the topic being processed.
+	// nil if unlimited.
+	slots chan struct{}
+}
+
+// a message as fed to the shared pool
+type routedMessage struct {
+	route *route
+	msg   messenger.Message
+}
+
+func NewMultiListener(
+	messenger messenger.Client,
+	inbox string,
+	numOfWorkers uint,
+) *MultiListener {
+	return &MultiListener{
+		inbox:        inbox,
+		numOfWorkers: numOfWorkers,
+		messenger:    messenger,
+		minBackoff:   defaultMinBackoff,
+		maxBackoff:   defaultMaxBackoff,
+		maxErrors:    defaultMaxErrors,
+		drainTimeout: defaultDrainTimeout,
+	}
+}
+
+// Route makes messages from topic go to handler, with at most
+// maxConcurrent of them being processed at the same time
+// (maxConcurrent < 1 means up to the number of workers).
+// topic is an exact topic name: patterns are not supported,
+// so each topic of a family must be routed on its own.
+// routing the same topic again replaces its handler.
+// must be called before Listen.
+func (ml *MultiListener) Route(
+	topic string,
+	handler Handler,
+	maxConcurrent int,
+) {
+	r := &route{
+		listener: NewHandlerListener(
+			ml.messenger, topic, ml.inbox, ml.numOfWorkers, handler),
+	}
+
+	if maxConcurrent > 0 {
+		r.slots = make(chan struct{}, maxConcurrent)
+	}
+
+	for i, other := range ml.routes {
+		if other.listener.topic == topic {
+			ml.routes[i] = r
+			return
+		}
+	}
+
+	ml.routes = append(ml.routes, r)
+}
+
+// SetDeadLetter sets the topic permanently failed messages
+// of every topic are sent to. see BrokerListener.SetDeadLetter.
+// must be called before Listen.
+func (ml *MultiListener) SetDeadLetter(topic string) {
+	ml.deadLetter = topic
+}
+
+// SetReconnect sets how each topic's reader recovers from
+// broker errors. see BrokerListener.SetReconnect.
+// must be called before Listen.
+func (ml *MultiListener) SetReconnect(
+	minBackoff time.Duration,
+	maxBackoff time.Duration,
+	maxErrors int,
+) {
+	ml.minBackoff = minBackoff
+	ml.maxBackoff = maxBackoff
+	ml.maxErrors = maxErrors
+}
+
+// SetDrainTimeout sets how long Listen waits for the workers
+// once ctx is done. see BrokerListener.SetDrainTimeout.
+// must be called before Listen.
+func (ml *MultiListener) SetDrainTimeout(d time.Duration) {
+	ml.drainTimeout = d
+}
+
+// Health returns the connection state of each topic.
+// key: topic.
+func (ml *MultiListener) Health() map[string]Health {
+	out := map[string]Health{}
+	for _, r := range ml.routes {
+		out[r.listener.topic] = r.listener.Health()
+	}
+	return out
+}
+
+// Listen reads every routed topic until ctx is done, then
+// waits for the workers to finish the messages they took (see
+// SetDrainTimeout) and closes the readers.
+// see BrokerListener.Listen.
+func (ml *MultiListener) Listen(
+	log *logging.Logger,
+	ctx context.Context,
+) {
+	l := log.New()
+
+	// in flight messages must finish after ctx is done
+	wp := workerpool.New(
+		ml.numOfWorkers, worker(context.WithoutCancel(ctx)))
+	wp.Start(l)
+
+	readers := make([]messenger.Reader, len(ml.routes))
+	wg := &sync.WaitGroup{}
+
+	for i, r := range ml.routes {
+		r.listener.SetDeadLetter(ml.deadLetter)
+		r.listener.SetReconnect(ml.minBackoff, ml.maxBackoff, ml.maxErrors)
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			readers[i] = r.listener.listen(l, ctx, r.feeder(wp))
+		}()
+	}
+
+	wg.Wait()
+
+	drain(l, wp, ml.drainTimeout)
+
+	for i, r := range ml.routes {
+		r.listener.close(l, readers[i])
+	}
+}
+
+// worker processes routed messages with their route's handler
+func worker(ctx context.Context) workerpool.WorkerFunc {
+	return func(log *logging.Logger, id string, in chan any) {
+		for p := range in {
+			rm := p.(*routedMessage)
+			rm.route.process(log, ctx, rm.msg)
+		}
+	}
+}
+
+// feeder returns the feed function of the route's reader.
+// it waits for a free slot of the route, so a busy topic
+// doesn't take every worker.
+func (r *route) feeder(
+	wp *workerpool.WorkersPool,
+) func(ctx context.Context, msg any) error {
+	return func(ctx context.Context, msg any) error {
+		if r.slots != nil {
+			select {
+			case r.slots <- struct{}{}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+
+		err := wp.FeedContext(ctx, &routedMessage{
+			route: r,
+			msg:   msg.(messenger.Message),
+		})
+		if err != nil {
+			r.release()
+		}
+
+		return err
+	}
+}
+
+func (r *route) process(
+	log *logging.Logger,
+	ctx context.Context,
+	msg messenger.Message,
+) {
+	// even if the handler panics
+	defer r.release()
+
+	r.listener.handle(log, ctx, msg)
+}
+
+func (r *route) release() {
+	if r.slots != nil {
+		<-r.slots
+	}
+}
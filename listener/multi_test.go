@@ -0,0 +1,103 @@
+package listener
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+	"utils/utils/testutils"
+)
+
+func TestMultiListener(t *testing.T) {
+
+	l := logging.New()
+
+	t.Run("routing and limits", func(t *testing.T) {
+
+		readers := map[string]*fakeReader{
+			"a": {msgs: make(chan messenger.Message, 10)},
+			"b": {msgs: make(chan messenger.Message, 10)},
+		}
+
+		client := &fakeClient{
+			newReader: func(from string) (messenger.Reader, error) {
+				return readers[from], nil
+			},
+		}
+
+		var wg sync.WaitGroup
+		mutex := &sync.Mutex{}
+		// key: topic
+		got := map[string][]string{}
+
+		var running, maxRunning atomic.Int32
+
+		handler := func(topic string) Handler {
+			return func(ctx context.Context, msg messenger.Message) error {
+				defer wg.Done()
+
+				if topic == "a" {
+					n := running.Add(1)
+					defer running.Add(-1)
+					if n > maxRunning.Load() {
+						maxRunning.Store(n)
+					}
+					time.Sleep(20 * time.Millisecond)
+				}
+
+				mutex.Lock()
+				defer mutex.Unlock()
+				got[topic] = append(got[topic], string(msg.Payload()))
+
+				return nil
+			}
+		}
+
+		ml := NewMultiListener(client, "inbox", 4)
+		ml.Route("a", handler("a"), 1)
+		ml.Route("b", handler("b"), 0)
+
+		msgs := []*fakeMessage{}
+		for topic, payloads := range map[string][]string{
+			"a": {"a1", "a2", "a3"},
+			"b": {"b1", "b2"},
+		} {
+			for _, p := range payloads {
+				m := &fakeMessage{payload: []byte(p)}
+				msgs = append(msgs, m)
+				readers[topic].msgs <- m
+				wg.Add(1)
+			}
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			ml.Listen(l, ctx)
+			close(done)
+		}()
+
+		wg.Wait()
+
+		health := ml.Health()
+		testutils.AssertInt(t, len(health), 2)
+		testutils.AssertBool(t, health["a"].Healthy(), true)
+		testutils.AssertBool(t, health["b"].Healthy(), true)
+
+		cancel()
+		<-done
+
+		testutils.AssertInt(t, len(got["a"]), 3)
+		testutils.AssertInt(t, len(got["b"]), 2)
+		testutils.AssertInt(t, int(maxRunning.Load()), 1)
+		for _, m := range msgs {
+			testutils.AssertBool(t, m.received.Load(), true)
+		}
+		testutils.AssertBool(t, readers["a"].closed.Load(), true)
+		testutils.AssertBool(t, readers["b"].closed.Load(), true)
+		testutils.AssertBool(t, ml.Health()["a"].Healthy(), false)
+	})
+}
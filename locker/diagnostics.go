@@ -0,0 +1,218 @@
+package locker
+
+import (
+	"container/list"
+	"sort"
+	"time"
+	"utils/logging"
+)
+
+// ids whose stats are kept, the most recently locked ones
+const maxLockStats = 1000
+
+type diagnostics struct {
+	log *logging.Logger
+	// holders are warned about after this long.
+	// 0 disables the warning.
+	holdWarning time.Duration
+	// stats of the most recently locked ids, first to last.
+	// kept apart from the entries, so they outlive them.
+	// guarded by globalMutex.
+	recent *list.List
+	// key: id. value: element of recent.
+	stats map[string]*list.Element
+}
+
+// current hold of an entry. guarded by globalMutex.
+type holdState struct {
+	since     time.Time
+	warnTimer *time.Timer
+}
+
+// per id contention stats. guarded by globalMutex.
+type lockStats struct {
+	id           string
+	acquisitions uint64
+	totalWait    time.Duration
+	maxWait      time.Duration
+	totalHold    time.Duration
+	maxHold      time.Duration
+}
+
+// LockInfo is the state of an id held, waited for, or
+// among the most recently locked ones.
+type LockInfo struct {
+	ID   string
+	Held bool
+	// zero if not held
+	HeldFor time.Duration
+	Waiters int
+	// since diagnostics were enabled, as long as the id
+	// stayed among the most recently locked ones
+	Acquisitions uint64
+	TotalWait    time.Duration
+	MaxWait      time.Duration
+	TotalHold    time.Duration
+	MaxHold      time.Duration
+}
+
+// SetDiagnostics enables wait and hold time tracking per id,
+// and a warning through log whenever a lock is held for
+// longer than holdWarning (0 disables the warning).
+// stats are kept for the most recently locked ids only.
+// must be called before the Locker is used.
+func (h *Locker) SetDiagnostics(
+	log *logging.Logger,
+	holdWarning time.Duration,
+) {
+	h.diagnostics = &diagnostics{
+		log:         log,
+		holdWarning: holdWarning,
+		recent:      list.New(),
+		stats:       map[string]*list.Element{},
+	}
+}
+
+// Snapshot lists the ids currently held or waited for, the
+// longest held first, and then the other ids with stats, the
+// most waited for first. empty if diagnostics are disabled.
+func (h *Locker) Snapshot() []LockInfo {
+
+	if h.diagnostics == nil {
+		return nil
+	}
+
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	d := h.diagnostics
+
+	out := make([]LockInfo, 0, max(len(h.mutexes), len(d.stats)))
+
+	for id, bM := range h.mutexes {
+		info := LockInfo{
+			ID:      id,
+			Held:    !bM.hold.since.IsZero(),
+			Waiters: bM.refs,
+		}
+
+		if info.Held {
+			info.HeldFor = time.Since(bM.hold.since)
+			info.Waiters--
+		}
+
+		if e, ok := d.stats[id]; ok {
+			info.setStats(e.Value.(*lockStats))
+		}
+
+		out = append(out, info)
+	}
+
+	for id, e := range d.stats {
+		if _, ok := h.mutexes[id]; ok {
+			continue
+		}
+
+		info := LockInfo{ID: id}
+		info.setStats(e.Value.(*lockStats))
+
+		out = append(out, info)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		if out[i].HeldFor != out[j].HeldFor {
+			return out[i].HeldFor > out[j].HeldFor
+		}
+		return out[i].TotalWait > out[j].TotalWait
+	})
+
+	return out
+}
+
+func (info *LockInfo) setStats(st *lockStats) {
+	info.Acquisitions = st.acquisitions
+	info.TotalWait = st.totalWait
+	info.MaxWait = st.maxWait
+	info.TotalHold = st.totalHold
+	info.MaxHold = st.maxHold
+}
+
+// returns the stats of "id", creating them if needed, and
+// makes it the most recently locked id, dropping the stats
+// of the least recent one if there are too many.
+// must be called with globalMutex held.
+func (d *diagnostics) statsOf(id string) *lockStats {
+
+	e, ok := d.stats[id]
+	if ok {
+		d.recent.MoveToFront(e)
+		return e.Value.(*lockStats)
+	}
+
+	st := &lockStats{id: id}
+	d.stats[id] = d.recent.PushFront(st)
+
+	if d.recent.Len() > maxLockStats {
+		last := d.recent.Remove(d.recent.Back()).(*lockStats)
+		delete(d.stats, last.id)
+	}
+
+	return st
+}
+
+// accounts that "id" was locked after waiting since start.
+// must be called with globalMutex held.
+func (h *Locker) locked(id string, bM *lockEntry, start time.Time) {
+
+	if h.diagnostics == nil {
+		return
+	}
+
+	now := time.Now()
+	wait := now.Sub(start)
+
+	bM.hold.since = now
+
+	st := h.diagnostics.statsOf(id)
+	st.acquisitions++
+	st.totalWait += wait
+	st.maxWait = max(st.maxWait, wait)
+
+	holdWarning := h.diagnostics.holdWarning
+	if holdWarning <= 0 {
+		return
+	}
+
+	bM.hold.warnTimer = time.AfterFunc(holdWarning, func() {
+		l := h.diagnostics.log.New()
+		l.Warn("lock %q held for more than %v (waited %v for it)",
+			id, holdWarning, wait)
+	})
+}
+
+// accounts that the entry of "id" was unlocked.
+// must be called with globalMutex held.
+func (h *Locker) unlocked(id string, bM *lockEntry) {
+
+	if h.diagnostics == nil {
+		return
+	}
+
+	hd := &bM.hold
+
+	if hd.warnTimer != nil {
+		hd.warnTimer.Stop()
+		hd.warnTimer = nil
+	}
+
+	if hd.since.IsZero() {
+		return
+	}
+
+	hold := time.Since(hd.since)
+	hd.since = time.Time{}
+
+	st := h.diagnostics.statsOf(id)
+	st.totalHold += hold
+	st.maxHold = max(st.maxHold, hold)
+}
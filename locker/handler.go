@@ -0,0 +1,66 @@
+package locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"utils/logging"
+)
+
+// Handler acquires locks identified by "id" that may be
+// shared between processes (depending on the implementation).
+type Handler interface {
+	// acquires the lock of "id", waiting until it is free
+	// or ctx is done. the lease expires after ttl unless
+	// renewed; ttl = 0 means no expiration, if supported.
+	// returns ErrInvalidTTL if ttl is not supported.
+	Acquire(
+		log *logging.Logger,
+		ctx context.Context,
+		id string,
+		ttl time.Duration,
+	) (
+		Lease,
+		error,
+	)
+}
+
+// Lease is a held lock.
+type Lease interface {
+	ID() string
+
+	// fencing token: it is greater for every new lease of
+	// the same id, so a resource can reject writes from a
+	// holder whose lease was lost.
+	Token() uint64
+
+	// extends the lease for ttl from now.
+	// returns ErrLeaseLost if it expired or was taken,
+	// and ErrInvalidTTL if ttl is not supported.
+	Renew(
+		log *logging.Logger,
+		ctx context.Context,
+		ttl time.Duration,
+	) error
+
+	// releases the lock. releasing a lost lease does nothing.
+	Release(
+		log *logging.Logger,
+		ctx context.Context,
+	) error
+}
+
+var (
+	ErrLeaseLost  = errors.New("lease lost")
+	ErrInvalidTTL = errors.New("invalid ttl")
+)
+
+// checkTTL rejects negative ttls, which would make leases
+// that are expired already.
+func checkTTL(ttl time.Duration) error {
+	if ttl < 0 {
+		return fmt.Errorf("%w: %v is negative", ErrInvalidTTL, ttl)
+	}
+	return nil
+}
@@ -0,0 +1,263 @@
+package locker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+	"utils/logging"
+	"utils/svcregistry"
+
+	"github.com/hashicorp/consul/api"
+)
+
+const (
+	// how long a blocking query waits for a busy lock to change
+	consulWaitTime = 1 * time.Minute
+	// how often a free lock that can't be acquired yet,
+	// because of the lock delay, is tried again
+	consulLockRetry = 1 * time.Second
+	// session TTLs accepted by Consul
+	consulMinTTL = 10 * time.Second
+	consulMaxTTL = 24 * time.Hour
+)
+
+// locks are Consul KV keys (prefix + id) acquired by a
+// session. the session TTL is the lease TTL: Consul accepts
+// from 10s to 24h, and may keep a session up to twice its
+// TTL before invalidating it. an invalidated session releases
+// its lock, which can then only be taken after the Consul
+// lock delay (15s by default). ttl = 0 is a session that
+// never expires.
+type consulHandler struct {
+	client *api.Client
+	prefix string
+}
+
+type consulLease struct {
+	h         *consulHandler
+	id        string
+	key       string
+	sessionID string
+	token     uint64
+	// TTL of the session
+	ttl time.Duration
+}
+
+func NewConsulHandler(
+	consulAddress string,
+	consulPort uint,
+	prefix string,
+) (
+	*consulHandler,
+	error,
+) {
+
+	client, err := svcregistry.NewConsulClient(
+		consulAddress, consulPort)
+	if err != nil {
+		return nil, err
+	}
+
+	return &consulHandler{
+		client: client,
+		prefix: prefix,
+	}, nil
+}
+
+func (h *consulHandler) Acquire(
+	log *logging.Logger,
+	ctx context.Context,
+	id string,
+	ttl time.Duration,
+) (
+	Lease,
+	error,
+) {
+
+	l := log.New()
+
+	if ttl != 0 && (ttl < consulMinTTL || ttl > consulMaxTTL) {
+		return nil, fmt.Errorf(
+			"%w: %v is not between %v and %v",
+			ErrInvalidTTL, ttl, consulMinTTL, consulMaxTTL)
+	}
+
+	entry := &api.SessionEntry{
+		Name:     "locker: " + id,
+		Behavior: api.SessionBehaviorRelease,
+	}
+	if ttl > 0 {
+		entry.TTL = ttl.String()
+	}
+
+	wopts := (&api.WriteOptions{}).WithContext(ctx)
+
+	sessionID, _, err := h.client.Session().Create(entry, wopts)
+	if err != nil {
+		return nil, fmt.Errorf("error creating session: %w", err)
+	}
+
+	ls := &consulLease{
+		h:         h,
+		id:        id,
+		key:       h.prefix + id,
+		sessionID: sessionID,
+		ttl:       ttl,
+	}
+
+	err = h.acquire(l, ctx, ls)
+	if err != nil {
+		// ctx may be done already
+		_, destroyErr := h.client.Session().Destroy(sessionID, nil)
+		if destroyErr != nil {
+			l.Error("error destroying session %v: %v",
+				sessionID, destroyErr)
+		}
+		return nil, err
+	}
+
+	return ls, nil
+}
+
+// waits until the key of ls is acquired by its session.
+// the fencing token is the key's modify index, which
+// increases on every acquisition.
+func (h *consulHandler) acquire(
+	log *logging.Logger,
+	ctx context.Context,
+	ls *consulLease,
+) error {
+
+	l := log.New()
+
+	kv := h.client.KV()
+
+	var waitIndex uint64
+
+	for {
+		acquired, _, err := kv.Acquire(
+			&api.KVPair{
+				Key:     ls.key,
+				Session: ls.sessionID,
+			},
+			(&api.WriteOptions{}).WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("error acquiring key: %w", err)
+		}
+
+		// blocks until the key changes (or consulWaitTime)
+		pair, meta, err := kv.Get(
+			ls.key,
+			(&api.QueryOptions{
+				WaitIndex: waitIndex,
+				WaitTime:  consulWaitTime,
+			}).WithContext(ctx),
+		)
+		if err != nil {
+			return fmt.Errorf("error getting key: %w", err)
+		}
+
+		if acquired && pair != nil && pair.Session == ls.sessionID {
+			ls.token = pair.ModifyIndex
+			l.Debug("acquired %v with token %v", ls.id, ls.token)
+			return nil
+		}
+
+		if pair == nil || pair.Session == "" {
+			// free, but in the lock delay after its holder's
+			// session was invalidated. the key doesn't change
+			// when the delay ends, so it is polled instead.
+			waitIndex = 0
+
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(consulLockRetry):
+			}
+
+			continue
+		}
+
+		// held by someone else: next Get waits
+		// for it to change before trying again
+		waitIndex = meta.LastIndex
+	}
+}
+
+func (ls *consulLease) ID() string {
+	return ls.id
+}
+
+func (ls *consulLease) Token() uint64 {
+	return ls.token
+}
+
+// Renew resets the session TTL. Consul sessions have a fixed
+// TTL, so ttl must be the one the lease was acquired with:
+// returns ErrInvalidTTL otherwise.
+func (ls *consulLease) Renew(
+	log *logging.Logger,
+	ctx context.Context,
+	ttl time.Duration,
+) error {
+
+	l := log.New()
+
+	if ttl != ls.ttl {
+		return fmt.Errorf(
+			"%w: session of %v has a fixed ttl of %v, not %v",
+			ErrInvalidTTL, ls.id, ls.ttl, ttl)
+	}
+
+	entry, _, err := ls.h.client.Session().Renew(
+		ls.sessionID,
+		(&api.WriteOptions{}).WithContext(ctx),
+	)
+	if err != nil {
+		var se api.StatusError
+		if errors.As(err, &se) && se.Code == 404 {
+			return ErrLeaseLost
+		}
+		return fmt.Errorf("error renewing session: %w", err)
+	}
+
+	if entry == nil {
+		l.Warn("lease of %v with token %v was lost",
+			ls.id, ls.token)
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+func (ls *consulLease) Release(
+	log *logging.Logger,
+	ctx context.Context,
+) error {
+
+	l := log.New()
+
+	wopts := (&api.WriteOptions{}).WithContext(ctx)
+
+	_, _, err := ls.h.client.KV().Release(
+		&api.KVPair{
+			Key:     ls.key,
+			Session: ls.sessionID,
+		},
+		wopts,
+	)
+	if err != nil {
+		return fmt.Errorf("error releasing key: %w", err)
+	}
+
+	_, err = ls.h.client.Session().Destroy(ls.sessionID, wopts)
+	if err != nil {
+		return fmt.Errorf("error destroying session: %w", err)
+	}
+
+	l.Debug("released %v with token %v", ls.id, ls.token)
+
+	return nil
+}
@@ -0,0 +1,46 @@
+package locker
+
+import (
+	"context"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+)
+
+func TestHandlerConsulTTL(t *testing.T) {
+
+	l := logging.New()
+
+	ctx := context.Background()
+
+	// ttls are checked before reaching consul
+	h, err := NewConsulHandler("localhost", 8500, "locks/")
+	testutils.AssertError(t, err, nil)
+
+	t.Run("acquire", func(t *testing.T) {
+
+		_, err := h.Acquire(l, ctx, "1", time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		_, err = h.Acquire(l, ctx, "1", 25*time.Hour)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		_, err = h.Acquire(l, ctx, "1", -time.Minute)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+	})
+
+	t.Run("renew", func(t *testing.T) {
+
+		ls := &consulLease{
+			h:   h,
+			id:  "1",
+			ttl: 10 * time.Second,
+		}
+
+		err := ls.Renew(l, ctx, 20*time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+	})
+}
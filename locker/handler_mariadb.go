@@ -0,0 +1,426 @@
+package locker
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+	"utils/logging"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+)
+
+const (
+	// duplicate entry for key
+	mysqlErrDuplicateEntry = 1062
+	// deadlock found when trying to get lock
+	mysqlErrDeadlock = 1213
+)
+
+// expiration of a lease with ttl (in microseconds) from
+// now, by the database clock. ttl = 0 never expires.
+const leaseExpirationExpr = `if(? = 0, null, now(6) + interval ? microsecond)`
+
+// leases are rows of locker_lease, one per id:
+//
+//	create table locker_lease (
+//		id varchar(255) not null primary key,
+//		owner varchar(36) not null,
+//		token bigint unsigned not null,
+//		expiration_date_time datetime(6) null
+//	);
+//
+// a released lease is expired instead of deleted, so
+// the token of its id keeps increasing.
+type mariaDBHandler struct {
+	db *sql.DB
+	// how often a busy lock is tried again
+	pollInterval time.Duration
+}
+
+type mariaDBLease struct {
+	h     *mariaDBHandler
+	id    string
+	owner string
+	token uint64
+}
+
+func NewMariaDBHandler(
+	db *sql.DB,
+	pollInterval time.Duration,
+) (
+	*mariaDBHandler,
+	error,
+) {
+
+	if db == nil {
+		return nil, errors.New("null db")
+	}
+
+	if pollInterval <= 0 {
+		return nil, errors.New("invalid poll interval")
+	}
+
+	return &mariaDBHandler{
+		db:           db,
+		pollInterval: pollInterval,
+	}, nil
+}
+
+func (h *mariaDBHandler) Acquire(
+	log *logging.Logger,
+	ctx context.Context,
+	id string,
+	ttl time.Duration,
+) (
+	Lease,
+	error,
+) {
+
+	l := log.New()
+
+	err := checkTTL(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	owner := uuid.NewString()
+
+	for {
+		token, acquired, err := h.tryAcquire(l, ctx, id, owner, ttl)
+		if err != nil {
+			return nil, fmt.Errorf("error acquiring %v: %w", id, err)
+		}
+
+		if acquired {
+			return &mariaDBLease{
+				h:     h,
+				id:    id,
+				owner: owner,
+				token: token,
+			}, nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(h.pollInterval):
+		}
+	}
+}
+
+// takes the lease of "id" if it is free (missing or expired).
+// returns its new token.
+func (h *mariaDBHandler) tryAcquire(
+	log *logging.Logger,
+	ctx context.Context,
+	id string,
+	owner string,
+	ttl time.Duration,
+) (
+	uint64,
+	bool,
+	error,
+) {
+
+	l := log.New()
+
+	tx, err := h.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, false, fmt.Errorf("error beginning tx: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	qry := `
+select 
+	token,
+	expiration_date_time is not null and
+		expiration_date_time <= now(6)
+from 
+	locker_lease
+where
+	id = ?
+for update
+`
+
+	var token uint64
+	var expired bool
+
+	err = tx.QueryRowContext(ctx, qry, id).Scan(&token, &expired)
+	switch {
+	case errors.Is(err, sql.ErrNoRows):
+		return h.insertLease(l, ctx, tx, id, owner, ttl)
+	case contended(err):
+		return 0, false, nil
+	case err != nil:
+		return 0, false, fmt.Errorf("error scanning: %w", err)
+	case !expired:
+		return 0, false, nil
+	}
+
+	cmd := `
+update 
+	locker_lease
+set
+	owner = ?,
+	token = token + 1,
+	expiration_date_time = ` + leaseExpirationExpr + `
+where
+	id = ?
+`
+
+	_, err = tx.ExecContext(
+		ctx,
+		cmd,
+		owner,
+		ttl.Microseconds(),
+		ttl.Microseconds(),
+		id,
+	)
+	if contended(err) {
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error exec: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, fmt.Errorf("error commiting tx: %w", err)
+	}
+
+	l.Debug("acquired %v with token %v", id, token+1)
+
+	return token + 1, true, nil
+}
+
+// creates the first lease of "id", with token 1.
+func (h *mariaDBHandler) insertLease(
+	log *logging.Logger,
+	ctx context.Context,
+	tx *sql.Tx,
+	id string,
+	owner string,
+	ttl time.Duration,
+) (
+	uint64,
+	bool,
+	error,
+) {
+
+	l := log.New()
+
+	cmd := `
+insert into	locker_lease(
+	id, 
+	owner, 
+	token,
+	expiration_date_time
+)
+values (
+	?,
+	?,
+	1,
+	` + leaseExpirationExpr + `
+)`
+
+	_, err := tx.ExecContext(
+		ctx,
+		cmd,
+		id,
+		owner,
+		ttl.Microseconds(),
+		ttl.Microseconds(),
+	)
+	if contended(err) {
+		// someone else created it first
+		return 0, false, nil
+	}
+	if err != nil {
+		return 0, false, fmt.Errorf("error exec: %w", err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, false, fmt.Errorf("error commiting tx: %w", err)
+	}
+
+	l.Debug("acquired %v with token 1", id)
+
+	return 1, true, nil
+}
+
+// reports whether err comes from racing someone else for
+// the same lease: under repeatable read, concurrent inserts of
+// a missing id deadlock on the gap lock of the select above
+// instead of failing as duplicates. either way, the lease is
+// busy and must be tried again.
+func contended(err error) bool {
+
+	var myErr *mysql.MySQLError
+	if !errors.As(err, &myErr) {
+		return false
+	}
+
+	return myErr.Number == mysqlErrDuplicateEntry ||
+		myErr.Number == mysqlErrDeadlock
+}
+
+func (ls *mariaDBLease) ID() string {
+	return ls.id
+}
+
+func (ls *mariaDBLease) Token() uint64 {
+	return ls.token
+}
+
+func (ls *mariaDBLease) Renew(
+	log *logging.Logger,
+	ctx context.Context,
+	ttl time.Duration,
+) error {
+
+	err := checkTTL(ttl)
+	if err != nil {
+		return err
+	}
+
+	cmd := `
+update 
+	locker_lease
+set
+	expiration_date_time = ` + leaseExpirationExpr + `
+where
+	id = ? and
+	owner = ? and
+	token = ? and
+	(
+		expiration_date_time is null or
+		expiration_date_time > now(6)
+	)
+`
+
+	return ls.update(log, ctx, cmd,
+		ttl.Microseconds(),
+		ttl.Microseconds(),
+		ls.id,
+		ls.owner,
+		ls.token,
+	)
+}
+
+func (ls *mariaDBLease) Release(
+	log *logging.Logger,
+	ctx context.Context,
+) error {
+
+	cmd := `
+update 
+	locker_lease
+set
+	expiration_date_time = now(6)
+where
+	id = ? and
+	owner = ? and
+	token = ? and
+	(
+		expiration_date_time is null or
+		expiration_date_time > now(6)
+	)
+`
+
+	err := ls.update(log, ctx, cmd,
+		ls.id,
+		ls.owner,
+		ls.token,
+	)
+	if errors.Is(err, ErrLeaseLost) {
+		return nil
+	}
+
+	return err
+}
+
+// runs cmd, returning ErrLeaseLost if it changed no row
+// and the lease is not held anymore.
+func (ls *mariaDBLease) update(
+	log *logging.Logger,
+	ctx context.Context,
+	cmd string,
+	args ...any,
+) error {
+
+	l := log.New()
+
+	res, err := ls.h.db.ExecContext(ctx, cmd, args...)
+	if err != nil {
+		return fmt.Errorf("error exec: %w", err)
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("error getting affected rows: %w", err)
+	}
+
+	if affected > 0 {
+		return nil
+	}
+
+	// the driver reports changed rows, so a matched row may
+	// be left as it was (renewing with ttl = 0 sets null to null)
+	held, err := ls.held(l, ctx)
+	if err != nil {
+		return err
+	}
+
+	if !held {
+		l.Warn("lease of %v with token %v was lost",
+			ls.id, ls.token)
+		return ErrLeaseLost
+	}
+
+	return nil
+}
+
+// reports whether the lease is still held by its owner
+func (ls *mariaDBLease) held(
+	log *logging.Logger,
+	ctx context.Context,
+) (
+	bool,
+	error,
+) {
+
+	qry := `
+select 
+	count(*)
+from 
+	locker_lease
+where
+	id = ? and
+	owner = ? and
+	token = ? and
+	(
+		expiration_date_time is null or
+		expiration_date_time > now(6)
+	)
+`
+
+	var count int
+
+	err := ls.h.db.QueryRowContext(
+		ctx,
+		qry,
+		ls.id,
+		ls.owner,
+		ls.token,
+	).Scan(&count)
+	if err != nil {
+		return false, fmt.Errorf("error scanning: %w", err)
+	}
+
+	return count > 0, nil
+}
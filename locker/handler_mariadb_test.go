@@ -0,0 +1,142 @@
+package locker
+
+import (
+	"context"
+	"database/sql"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/google/uuid"
+)
+
+func TestHandlerMariaDB(t *testing.T) {
+
+	l := logging.New()
+
+	ctx := context.Background()
+
+	db, err := sql.Open(
+		"mysql",
+		"root:baba@tcp(localhost:3306)/test?parseTime=true",
+	)
+	if err != nil {
+		t.Fatalf("error opening db: %v", err)
+	}
+
+	h, err := NewMariaDBHandler(db, 10*time.Millisecond)
+	testutils.AssertError(t, err, nil)
+
+	t.Run("exclusion and tokens", func(t *testing.T) {
+
+		id := uuid.NewString()
+
+		ls, err := h.Acquire(l, ctx, id, time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertBool(t, ls.Token() == 1, true)
+
+		cctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		_, err = h.Acquire(l, cctx, id, time.Second)
+		testutils.AssertError(t, err, context.DeadlineExceeded)
+
+		err = ls.Renew(l, ctx, time.Second)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, time.Second)
+		testutils.AssertError(t, err, ErrLeaseLost)
+
+		ls2, err := h.Acquire(l, ctx, id, time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertBool(t, ls2.Token() == 2, true)
+
+		err = ls2.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+
+	t.Run("negative ttl", func(t *testing.T) {
+
+		id := uuid.NewString()
+
+		_, err := h.Acquire(l, ctx, id, -time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		ls, err := h.Acquire(l, ctx, id, time.Second)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, -time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+
+	t.Run("renew without expiration", func(t *testing.T) {
+
+		id := uuid.NewString()
+
+		ls, err := h.Acquire(l, ctx, id, 0)
+		testutils.AssertError(t, err, nil)
+
+		// sets no expiration again: the row is left as it was
+		err = ls.Renew(l, ctx, 0)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, 0)
+		testutils.AssertError(t, err, ErrLeaseLost)
+
+	})
+
+	t.Run("concurrent first acquisitions", func(t *testing.T) {
+
+		id := uuid.NewString()
+
+		qty := 10
+		errs := make(chan error, qty)
+
+		for range qty {
+			go func() {
+				ls, err := h.Acquire(l, ctx, id, time.Second)
+				if err != nil {
+					errs <- err
+					return
+				}
+				errs <- ls.Release(l, ctx)
+			}()
+		}
+
+		for range qty {
+			testutils.AssertError(t, <-errs, nil)
+		}
+
+	})
+
+	t.Run("expired lease is taken", func(t *testing.T) {
+
+		id := uuid.NewString()
+
+		ls, err := h.Acquire(l, ctx, id, 20*time.Millisecond)
+		testutils.AssertError(t, err, nil)
+
+		ls2, err := h.Acquire(l, ctx, id, time.Second)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, time.Second)
+		testutils.AssertError(t, err, ErrLeaseLost)
+
+		err = ls2.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+}
@@ -0,0 +1,143 @@
+package locker
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+	"utils/logging"
+)
+
+// fencing tokens of in memory leases. a single sequence
+// for every id is enough for them to always increase.
+var ramTokens atomic.Uint64
+
+// in memory lease over a Locker lock
+type ramLease struct {
+	handle *Handle
+	token  uint64
+
+	mutex *sync.Mutex
+	// nil if no expiration
+	timer *time.Timer
+	// incremented on every renewal, so a timer that
+	// fired while renewing does not expire the lease
+	generation int
+	expired    bool
+}
+
+// Acquire implements Handler with the in memory locks,
+// so it only excludes goroutines of this process.
+func (h *Locker) Acquire(
+	log *logging.Logger,
+	ctx context.Context,
+	id string,
+	ttl time.Duration,
+) (
+	Lease,
+	error,
+) {
+
+	err := checkTTL(ttl)
+	if err != nil {
+		return nil, err
+	}
+
+	hd, err := h.LockContext(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	ls := &ramLease{
+		handle: hd,
+		token:  ramTokens.Add(1),
+		mutex:  &sync.Mutex{},
+	}
+
+	ls.schedule(ttl)
+
+	return ls, nil
+}
+
+// sets the lease to expire in ttl.
+// must be called with mutex held (or before sharing ls).
+func (ls *ramLease) schedule(ttl time.Duration) {
+
+	if ls.timer != nil {
+		ls.timer.Stop()
+		ls.timer = nil
+	}
+
+	ls.generation++
+
+	if ttl <= 0 {
+		return
+	}
+
+	generation := ls.generation
+	ls.timer = time.AfterFunc(ttl, func() {
+		ls.expire(generation)
+	})
+}
+
+func (ls *ramLease) expire(generation int) {
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.expired || generation != ls.generation {
+		return
+	}
+
+	ls.expired = true
+	ls.handle.Unlock()
+}
+
+func (ls *ramLease) ID() string {
+	return ls.handle.ID()
+}
+
+func (ls *ramLease) Token() uint64 {
+	return ls.token
+}
+
+func (ls *ramLease) Renew(
+	log *logging.Logger,
+	ctx context.Context,
+	ttl time.Duration,
+) error {
+
+	err := checkTTL(ttl)
+	if err != nil {
+		return err
+	}
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.expired {
+		return ErrLeaseLost
+	}
+
+	ls.schedule(ttl)
+
+	return nil
+}
+
+func (ls *ramLease) Release(
+	log *logging.Logger,
+	ctx context.Context,
+) error {
+
+	ls.mutex.Lock()
+	defer ls.mutex.Unlock()
+
+	if ls.timer != nil {
+		ls.timer.Stop()
+	}
+
+	// unlocking twice is harmless: handles unlock once
+	ls.expired = true
+	ls.handle.Unlock()
+
+	return nil
+}
@@ -0,0 +1,95 @@
+package locker
+
+import (
+	"context"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+)
+
+func TestHandlerRAM(t *testing.T) {
+
+	l := logging.New()
+
+	ctx := context.Background()
+
+	var h Handler = NewLocker()
+
+	t.Run("tokens increase", func(t *testing.T) {
+
+		ls, err := h.Acquire(l, ctx, "1", 0)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+		ls2, err := h.Acquire(l, ctx, "1", 0)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertBool(t, ls2.Token() > ls.Token(), true)
+
+		err = ls2.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+
+	t.Run("lease expires", func(t *testing.T) {
+
+		ls, err := h.Acquire(l, ctx, "1", 20*time.Millisecond)
+		testutils.AssertError(t, err, nil)
+
+		// waits for the expiration
+		ls2, err := h.Acquire(l, ctx, "1", 0)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, time.Second)
+		testutils.AssertError(t, err, ErrLeaseLost)
+
+		// releasing the lost lease must not release ls2
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+		cctx, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+		defer cancel()
+
+		_, err = h.Acquire(l, cctx, "1", 0)
+		testutils.AssertError(t, err, context.DeadlineExceeded)
+
+		err = ls2.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+
+	t.Run("renew keeps lease", func(t *testing.T) {
+
+		ls, err := h.Acquire(l, ctx, "1", 50*time.Millisecond)
+		testutils.AssertError(t, err, nil)
+
+		for range 4 {
+			time.Sleep(25 * time.Millisecond)
+			err = ls.Renew(l, ctx, 50*time.Millisecond)
+			testutils.AssertError(t, err, nil)
+		}
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+
+	t.Run("negative ttl", func(t *testing.T) {
+
+		_, err := h.Acquire(l, ctx, "1", -time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		ls, err := h.Acquire(l, ctx, "1", time.Second)
+		testutils.AssertError(t, err, nil)
+
+		err = ls.Renew(l, ctx, -time.Second)
+		testutils.AssertError(t, err, ErrInvalidTTL)
+
+		err = ls.Release(l, ctx)
+		testutils.AssertError(t, err, nil)
+
+	})
+}
@@ -1,6 +1,16 @@
 package locker
 
-import "sync"
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrLocked  = errors.New("locked")
+	ErrTimeout = errors.New("timeout waiting for lock")
+)
 
 // locks (in memory) by "id".
 // example: there can be a Locker object that prevents
@@ -8,31 +18,140 @@ import "sync"
 // identified by "id"
 type Locker struct {
 	globalMutex *sync.Mutex
-	mutexes     map[string]*sync.Mutex
+	// key: id. entries are removed once nobody
+	// holds or waits for them.
+	mutexes map[string]*lockEntry
+	// nil if disabled. see diagnostics.go.
+	diagnostics *diagnostics
+}
+
+type lockEntry struct {
+	// the lock is held while it holds a token
+	lock chan struct{}
+	// goroutines holding or waiting for the lock.
+	// guarded by globalMutex.
+	refs int
+	// generation of the current hold, 0 if not held.
+	// every hold gets a new one, so only its owner can
+	// release it. guarded by globalMutex.
+	owner uint64
+	// last generation given out. guarded by globalMutex.
+	gens uint64
+	// the current hold was taken by Lock, so it is
+	// released by Unlock(id). guarded by globalMutex.
+	legacy bool
+	hold   holdState
+}
+
+// Handle is a held lock. only its holder can unlock it,
+// and unlocking it more than once does nothing.
+type Handle struct {
+	locker *Locker
+	id     string
+	entry  *lockEntry
+	gen    uint64
+	once   *sync.Once
 }
 
 func NewLocker() *Locker {
 	return &Locker{
 		globalMutex: &sync.Mutex{},
-		mutexes:     map[string]*sync.Mutex{},
+		mutexes:     map[string]*lockEntry{},
 	}
 }
 
-// locks a lock identified by "id"
-func (h *Locker) Lock(id string) {
+// returns the entry of "id", creating it if needed,
+// with a reference taken for the caller.
+func (h *Locker) acquire(id string) *lockEntry {
 	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
 
 	bM, ok := h.mutexes[id]
 	if !ok {
-		bM = &sync.Mutex{}
+		bM = &lockEntry{
+			lock: make(chan struct{}, 1),
+		}
 		h.mutexes[id] = bM
 	}
-	h.globalMutex.Unlock()
 
-	bM.Lock()
+	bM.refs++
+
+	return bM
+}
+
+// drops a reference to the entry of "id", removing it
+// if it was the last one. must be called with globalMutex held.
+func (h *Locker) release(id string, bM *lockEntry) {
+	bM.refs--
+	if bM.refs == 0 {
+		delete(h.mutexes, id)
+	}
+}
+
+// gives up waiting for the entry of "id"
+func (h *Locker) abandon(id string, bM *lockEntry) {
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	h.release(id, bM)
+}
+
+// makes the caller, which just got the token of the entry
+// of "id" after waiting since start, its owner.
+// returns the generation of the new hold.
+func (h *Locker) hold(
+	id string,
+	bM *lockEntry,
+	start time.Time,
+	legacy bool,
+) uint64 {
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	bM.gens++
+	bM.owner = bM.gens
+	bM.legacy = legacy
+
+	h.locked(id, bM, start)
+
+	return bM.owner
+}
+
+// releases the hold of the entry of "id".
+// must be called with globalMutex held, by its owner.
+func (h *Locker) drop(id string, bM *lockEntry) {
+	bM.owner = 0
+	bM.legacy = false
+	<-bM.lock
+	h.unlocked(id, bM)
+	h.release(id, bM)
+}
+
+// releases the entry of "id" if it is still held
+// under generation gen.
+func (h *Locker) unlock(id string, bM *lockEntry, gen uint64) {
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	if bM.owner != gen {
+		// the hold of gen is over
+		return
+	}
+
+	h.drop(id, bM)
+}
+
+// locks a lock identified by "id"
+func (h *Locker) Lock(id string) {
+	start := time.Now()
+	bM := h.acquire(id)
+	bM.lock <- struct{}{}
+	h.hold(id, bM, start, true)
 }
 
-// unlocks a lock identified by "id"
+// unlocks a lock identified by "id".
+// only releases holds taken by Lock: locks held
+// through a Handle are only released by it.
 func (h *Locker) Unlock(id string) {
 
 	h.globalMutex.Lock()
@@ -44,5 +163,101 @@ func (h *Locker) Unlock(id string) {
 		return
 	}
 
-	bM.Unlock()
+	if bM.owner == 0 || !bM.legacy {
+		// not locked by Lock, do nothing
+		return
+	}
+
+	h.drop(id, bM)
+}
+
+// locks "id" only if it is free right now.
+// returns ErrLocked otherwise.
+func (h *Locker) TryLock(id string) (*Handle, error) {
+
+	start := time.Now()
+	bM := h.acquire(id)
+
+	select {
+	case bM.lock <- struct{}{}:
+		return h.newHandle(id, bM, start), nil
+	default:
+		h.abandon(id, bM)
+		return nil, ErrLocked
+	}
+}
+
+// locks "id", waiting until it is free or ctx is done.
+// returns ctx's error if it gives up.
+func (h *Locker) LockContext(
+	ctx context.Context,
+	id string,
+) (
+	*Handle,
+	error,
+) {
+
+	start := time.Now()
+	bM := h.acquire(id)
+
+	select {
+	case bM.lock <- struct{}{}:
+		return h.newHandle(id, bM, start), nil
+	case <-ctx.Done():
+		h.abandon(id, bM)
+		return nil, ctx.Err()
+	}
+}
+
+// locks "id", waiting up to timeout for it to be free.
+// returns ErrTimeout if it gives up.
+func (h *Locker) LockTimeout(
+	id string,
+	timeout time.Duration,
+) (
+	*Handle,
+	error,
+) {
+
+	start := time.Now()
+	bM := h.acquire(id)
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case bM.lock <- struct{}{}:
+		return h.newHandle(id, bM, start), nil
+	case <-timer.C:
+		h.abandon(id, bM)
+		return nil, ErrTimeout
+	}
+}
+
+// makes a handle owning the entry of "id", which the caller
+// just got the token of after waiting since start.
+func (h *Locker) newHandle(
+	id string,
+	bM *lockEntry,
+	start time.Time,
+) *Handle {
+	return &Handle{
+		locker: h,
+		id:     id,
+		entry:  bM,
+		gen:    h.hold(id, bM, start, false),
+		once:   &sync.Once{},
+	}
+}
+
+// ID returns the id of the held lock
+func (hd *Handle) ID() string {
+	return hd.id
+}
+
+// unlocks the held lock
+func (hd *Handle) Unlock() {
+	hd.once.Do(func() {
+		hd.locker.unlock(hd.id, hd.entry, hd.gen)
+	})
 }
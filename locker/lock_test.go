@@ -0,0 +1,310 @@
+package locker
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+)
+
+func TestLocker(t *testing.T) {
+
+	t.Run("try lock", func(t *testing.T) {
+
+		h := NewLocker()
+
+		hd, err := h.TryLock("1")
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, hd.ID(), "1")
+
+		_, err = h.TryLock("1")
+		testutils.AssertError(t, err, ErrLocked)
+
+		// other ids are independent
+		other, err := h.TryLock("2")
+		testutils.AssertError(t, err, nil)
+		other.Unlock()
+
+		hd.Unlock()
+
+		hd2, err := h.TryLock("1")
+		testutils.AssertError(t, err, nil)
+
+		// unlocking a stale handle must not release
+		// the lock held by hd2
+		hd.Unlock()
+
+		_, err = h.TryLock("1")
+		testutils.AssertError(t, err, ErrLocked)
+
+		// nor can a stranger through Unlock(id)
+		h.Unlock("1")
+
+		_, err = h.TryLock("1")
+		testutils.AssertError(t, err, ErrLocked)
+
+		hd2.Unlock()
+
+		// a lock taken by Lock is not released by a stale
+		// handle either
+		h.Lock("1")
+		hd2.Unlock()
+		hd.Unlock()
+
+		_, err = h.TryLock("1")
+		testutils.AssertError(t, err, ErrLocked)
+
+		h.Unlock("1")
+
+		hd3, err := h.TryLock("1")
+		testutils.AssertError(t, err, nil)
+		hd3.Unlock()
+
+	})
+
+	t.Run("lock timeout", func(t *testing.T) {
+
+		h := NewLocker()
+
+		h.Lock("1")
+
+		_, err := h.LockTimeout("1", 20*time.Millisecond)
+		testutils.AssertError(t, err, ErrTimeout)
+
+		h.Unlock("1")
+
+		hd, err := h.LockTimeout("1", 20*time.Millisecond)
+		testutils.AssertError(t, err, nil)
+		hd.Unlock()
+
+	})
+
+	t.Run("lock context", func(t *testing.T) {
+
+		h := NewLocker()
+
+		hd, err := h.LockContext(context.Background(), "1")
+		testutils.AssertError(t, err, nil)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			cancel()
+		}()
+
+		_, err = h.LockContext(ctx, "1")
+		testutils.AssertError(t, err, context.Canceled)
+
+		hd.Unlock()
+
+	})
+}
+
+func TestLockerCleanup(t *testing.T) {
+
+	h := NewLocker()
+
+	qtyGoroutines := 50
+	qtyIDs := 200
+	iterations := 2000
+
+	// key: id. must never go above 1 if no lock is lost
+	// when entries are removed.
+	holders := make([]int32, qtyIDs)
+
+	var maxEntries atomic.Int64
+	var wg sync.WaitGroup
+
+	for g := range qtyGoroutines {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for i := range iterations {
+				n := (g*iterations + i*7) % qtyIDs
+				id := fmt.Sprintf("customer-%d", n)
+
+				var hd *Handle
+				var err error
+
+				switch i % 3 {
+				case 0:
+					h.Lock(id)
+				case 1:
+					hd, err = h.LockTimeout(id, time.Millisecond)
+					if err != nil {
+						continue
+					}
+				case 2:
+					hd, err = h.TryLock(id)
+					if err != nil {
+						continue
+					}
+				}
+
+				if atomic.AddInt32(&holders[n], 1) != 1 {
+					t.Errorf("lock of %v held twice", id)
+				}
+
+				h.globalMutex.Lock()
+				entries := int64(len(h.mutexes))
+				h.globalMutex.Unlock()
+
+				for {
+					cur := maxEntries.Load()
+					if entries <= cur ||
+						maxEntries.CompareAndSwap(cur, entries) {
+						break
+					}
+				}
+
+				atomic.AddInt32(&holders[n], -1)
+
+				if hd != nil {
+					hd.Unlock()
+				} else {
+					h.Unlock(id)
+				}
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	// each goroutine references at most one entry at a time
+	testutils.AssertBool(
+		t, maxEntries.Load() <= int64(qtyGoroutines), true,
+	)
+
+	// nobody holds or waits for any lock
+	testutils.AssertInt(t, len(h.mutexes), 0)
+}
+
+func TestRWLocker(t *testing.T) {
+
+	t.Run("readers share, writer excludes", func(t *testing.T) {
+
+		h := NewRWLocker()
+
+		h.RLock("1")
+		h.RLock("1")
+
+		locked := make(chan struct{})
+		go func() {
+			h.Lock("1")
+			close(locked)
+		}()
+
+		select {
+		case <-locked:
+			t.Fatalf("writer locked while readers held the lock")
+		case <-time.After(20 * time.Millisecond):
+		}
+
+		h.RUnlock("1")
+		h.RUnlock("1")
+
+		<-locked
+		h.Unlock("1")
+
+		testutils.AssertInt(t, len(h.mutexes), 0)
+
+	})
+
+	t.Run("lock many", func(t *testing.T) {
+
+		h := NewRWLocker()
+
+		var wg sync.WaitGroup
+
+		// opposite orders would deadlock without
+		// canonical ordering
+		for i := range 100 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				ids := []string{"a", "b", "c"}
+				if i%2 == 0 {
+					ids = []string{"c", "b", "a", "b"}
+				}
+				h.LockMany(ids...)
+				h.UnlockMany(ids...)
+			}()
+		}
+
+		wg.Wait()
+
+		testutils.AssertInt(t, len(h.mutexes), 0)
+
+	})
+}
+
+func TestLockerDiagnostics(t *testing.T) {
+
+	h := NewLocker()
+	h.SetDiagnostics(logging.New(), 10*time.Millisecond)
+
+	h.Lock("1")
+
+	locked := make(chan struct{})
+	go func() {
+		h.Lock("1")
+		close(locked)
+	}()
+
+	// waiter shows up
+	for {
+		snap := h.Snapshot()
+		if len(snap) == 1 && snap[0].Waiters == 1 {
+			testutils.AssertString(t, snap[0].ID, "1")
+			testutils.AssertBool(t, snap[0].Held, true)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// long enough for the hold warning
+	time.Sleep(20 * time.Millisecond)
+
+	h.Unlock("1")
+	<-locked
+
+	snap := h.Snapshot()
+	testutils.AssertInt(t, len(snap), 1)
+	testutils.AssertInt(t, snap[0].Waiters, 0)
+	testutils.AssertInt(t, int(snap[0].Acquisitions), 2)
+	testutils.AssertBool(t, snap[0].MaxWait >= 20*time.Millisecond, true)
+	testutils.AssertBool(t, snap[0].MaxHold >= 20*time.Millisecond, true)
+
+	h.Unlock("1")
+
+	// stats outlive the idle entry
+	testutils.AssertInt(t, len(h.mutexes), 0)
+
+	snap = h.Snapshot()
+	testutils.AssertInt(t, len(snap), 1)
+	testutils.AssertBool(t, snap[0].Held, false)
+	testutils.AssertInt(t, int(snap[0].Acquisitions), 2)
+
+	// only the most recently locked ids are kept
+	for i := range maxLockStats + 10 {
+		id := fmt.Sprintf("customer-%d", i)
+		h.Lock(id)
+		h.Unlock(id)
+	}
+
+	snap = h.Snapshot()
+	testutils.AssertInt(t, len(snap), maxLockStats)
+
+	ids := map[string]bool{}
+	for _, info := range snap {
+		ids[info.ID] = true
+	}
+	testutils.AssertBool(t, ids["1"], false)
+	testutils.AssertBool(t, ids["customer-9"], false)
+	testutils.AssertBool(t, ids["customer-10"], true)
+}
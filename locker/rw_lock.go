@@ -0,0 +1,126 @@
+package locker
+
+import (
+	"sort"
+	"sync"
+	"utils/utils/sliceutils"
+)
+
+// read/write locks (in memory) by "id".
+// many readers or a single writer can hold the lock
+// of an id at a time.
+type RWLocker struct {
+	globalMutex *sync.Mutex
+	// key: id. entries are removed once nobody
+	// holds or waits for them.
+	mutexes map[string]*rwLockEntry
+}
+
+type rwLockEntry struct {
+	mutex *sync.RWMutex
+	// goroutines holding or waiting for the lock.
+	// guarded by globalMutex.
+	refs int
+}
+
+func NewRWLocker() *RWLocker {
+	return &RWLocker{
+		globalMutex: &sync.Mutex{},
+		mutexes:     map[string]*rwLockEntry{},
+	}
+}
+
+// returns the entry of "id", creating it if needed,
+// with a reference taken for the caller.
+func (h *RWLocker) acquire(id string) *rwLockEntry {
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	bM, ok := h.mutexes[id]
+	if !ok {
+		bM = &rwLockEntry{
+			mutex: &sync.RWMutex{},
+		}
+		h.mutexes[id] = bM
+	}
+
+	bM.refs++
+
+	return bM
+}
+
+// unlocks the entry of "id" with f, dropping its reference.
+func (h *RWLocker) release(id string, f func(m *sync.RWMutex)) {
+	h.globalMutex.Lock()
+	defer h.globalMutex.Unlock()
+
+	bM, ok := h.mutexes[id]
+	if !ok {
+		// if not found, do nothing
+		return
+	}
+
+	f(bM.mutex)
+
+	bM.refs--
+	if bM.refs == 0 {
+		delete(h.mutexes, id)
+	}
+}
+
+// locks "id" for reading
+func (h *RWLocker) RLock(id string) {
+	h.acquire(id).mutex.RLock()
+}
+
+// unlocks "id" for reading
+func (h *RWLocker) RUnlock(id string) {
+	h.release(id, (*sync.RWMutex).RUnlock)
+}
+
+// locks "id" for writing
+func (h *RWLocker) Lock(id string) {
+	h.acquire(id).mutex.Lock()
+}
+
+// unlocks "id" for writing
+func (h *RWLocker) Unlock(id string) {
+	h.release(id, (*sync.RWMutex).Unlock)
+}
+
+// locks all ids for writing. they are locked in a canonical
+// (sorted) order, so two goroutines locking overlapping
+// ids can't deadlock. repeated ids are locked once.
+func (h *RWLocker) LockMany(ids ...string) {
+	for _, id := range canonical(ids) {
+		h.Lock(id)
+	}
+}
+
+// unlocks all ids locked by LockMany
+func (h *RWLocker) UnlockMany(ids ...string) {
+	for _, id := range canonical(ids) {
+		h.Unlock(id)
+	}
+}
+
+// locks all ids. see RWLocker.LockMany.
+func (h *Locker) LockMany(ids ...string) {
+	for _, id := range canonical(ids) {
+		h.Lock(id)
+	}
+}
+
+// unlocks all ids locked by LockMany
+func (h *Locker) UnlockMany(ids ...string) {
+	for _, id := range canonical(ids) {
+		h.Unlock(id)
+	}
+}
+
+// returns ids sorted and without repetitions
+func canonical(ids []string) []string {
+	out := sliceutils.Unique(ids)
+	sort.Strings(out)
+	return out
+}
@@ -2,7 +2,6 @@ package messenger
 
 import (
 	"context"
-	"encoding/json"
 	"fmt"
 	"time"
 	"utils/logging"
@@ -23,15 +22,21 @@ func (te *TimeoutError) Error() string {
 type pulsarMessage struct {
 	consumer pulsar.Consumer
 	message  pulsar.Message
+	topic    string
+	codecs   *codecs
 }
 
 func newMessage(
 	message pulsar.Message,
 	consumer pulsar.Consumer,
+	topic string,
+	codecs *codecs,
 ) *pulsarMessage {
 	return &pulsarMessage{
 		consumer: consumer,
 		message:  message,
+		topic:    topic,
+		codecs:   codecs,
 	}
 }
 
@@ -39,9 +44,10 @@ func newMessage(
 func (m *pulsarMessage) WriteToModel(
 	model any,
 ) error {
-	err := json.Unmarshal(m.message.Payload(), model)
+	err := m.codecs.decode(
+		m.topic, m.message.Properties(), m.message.Payload(), model)
 	if err != nil {
-		return fmt.Errorf("failed to decode message: %#v", err)
+		return fmt.Errorf("failed to decode message: %w", err)
 	}
 	return nil
 }
@@ -51,6 +57,36 @@ func (m *pulsarMessage) Payload() []byte {
 	return m.message.Payload()
 }
 
+// ID returns message's broker ID
+func (m *pulsarMessage) ID() string {
+	return m.message.ID().String()
+}
+
+// Key returns message's key
+func (m *pulsarMessage) Key() string {
+	return m.message.Key()
+}
+
+// Properties returns message's properties
+func (m *pulsarMessage) Properties() map[string]string {
+	return m.message.Properties()
+}
+
+// EventTime returns message's event time
+func (m *pulsarMessage) EventTime() time.Time {
+	return m.message.EventTime()
+}
+
+// PublishTime returns when message was published
+func (m *pulsarMessage) PublishTime() time.Time {
+	return m.message.PublishTime()
+}
+
+// RedeliveryCount returns how many times message was delivered again
+func (m *pulsarMessage) RedeliveryCount() uint32 {
+	return m.message.RedeliveryCount()
+}
+
 // Received marks a message as received
 func (m *pulsarMessage) Received() {
 	m.consumer.Ack(m.message)
@@ -77,14 +113,26 @@ const (
 	// and the others have to wait their turn in line until the first abandon it
 	FailoverInbox
 
-	// KeyShared subscription mode, multiple consumer will be able to use the same
-	// subscription and all messages with the same key will be dispatched to only one consumer
-	//KeyShared
+	// KeySharedInbox like SharedInbox, several readers share the inbox, but all messages
+	// with the same key (see SendOptions.Key) go to the same reader. so messages with
+	// the same key are read in the order they were sent, while messages with different
+	// keys are spread between readers. messages without a key all share the same
+	// (empty) key. the order of a key may be broken only when readers join or leave,
+	// if a message of that key is given back, or if the reader doesn't ack one before
+	// the next.
+	KeySharedInbox
+
+	// TransientInbox like ExclusiveInbox, but the inbox doesn't outlive its reader: it
+	// is removed once the reader closes or disconnects (or its client goes away), so
+	// short lived readers that want their own copy of every message leave nothing behind
+	TransientInbox
 )
 
 // Reader represents a message reader
 type pulsarReader struct {
 	consumer pulsar.Consumer
+	topic    string
+	codecs   *codecs
 }
 
 // Get receives a message, writes its content to a model and mark it as received
@@ -116,10 +164,10 @@ func (r *pulsarReader) Peek(
 		}
 		return nil, fmt.Errorf("failed to consume message: %#v", err)
 	}
-	return newMessage(msg, r.consumer), nil
+	return newMessage(msg, r.consumer, r.topic, r.codecs), nil
 }
 
-// Close finishes the reader
+// Close unsubscribes and finishes the reader
 func (r *pulsarReader) Close(log *logging.Logger) {
 	l := log.New()
 	if err := r.consumer.Unsubscribe(); err != nil {
@@ -128,9 +176,18 @@ func (r *pulsarReader) Close(log *logging.Logger) {
 	r.consumer.Close()
 }
 
+// Disconnect finishes the reader, keeping its subscription
+func (r *pulsarReader) Disconnect(log *logging.Logger) {
+	r.consumer.Close()
+}
+
 // Client represents a message broker client
 type pulsarClient struct {
 	client pulsar.Client
+	// see producer.go
+	producers *producerCache
+	// see codec.go
+	codecs *codecs
 }
 
 // NewClient creates an instance of a messenger client
@@ -148,32 +205,67 @@ func NewClient(
 		return nil, fmt.Errorf("could not instantiate Pulsar client: %#v", err)
 	}
 	return &pulsarClient{
-		client: client,
+		client:    client,
+		producers: newProducerCache(client.CreateProducer),
+		codecs:    newCodecs(),
 	}, nil
 }
 
 // Send posts a model based message to message broker
 func (m *pulsarClient) Send(to string, model interface{}) error {
-	producer, err := m.client.CreateProducer(pulsar.ProducerOptions{
-		Topic: to,
-	})
+	return m.SendWithOptions(to, model, SendOptions{})
+}
+
+// SendWithOptions posts a model based message with the
+// given attributes to message broker
+func (m *pulsarClient) SendWithOptions(
+	to string,
+	model any,
+	opts SendOptions,
+) error {
+	payload, properties, err := m.codecs.encode(to, model, opts.Properties)
 	if err != nil {
-		return fmt.Errorf("failed to create producer: %#v", err)
+		return fmt.Errorf("failed to encode message: %w", err)
 	}
-	defer producer.Close()
-	payload, err := json.Marshal(model)
+	opts.Properties = properties
+	return m.SendRaw(to, payload, opts)
+}
+
+// SendRaw posts payload as it is, with the given attributes,
+// to message broker. no codec is involved: properties, such
+// as the content type, are sent as they are.
+func (m *pulsarClient) SendRaw(
+	to string,
+	payload []byte,
+	opts SendOptions,
+) error {
+	cp, err := m.producers.acquire(to)
 	if err != nil {
-		return fmt.Errorf("failed to encode message: %#v", err)
+		return err
 	}
-	_, err = producer.Send(context.Background(), &pulsar.ProducerMessage{
-		Payload: payload,
-	})
+	defer m.producers.release(cp)
+	_, err = cp.producer.Send(context.Background(),
+		opts.producerMessage(payload))
 	if err != nil {
 		return fmt.Errorf("failed to publish message: %#v", err)
 	}
 	return nil
 }
 
+// SetCodec sets the codec of topics without their own
+// (see SetTopicCodec). JSONCodec by default.
+// must be called before sending or reading.
+func (m *pulsarClient) SetCodec(codec Codec) {
+	m.codecs.defaultCodec = codec
+}
+
+// SetTopicCodec sets the codec messages sent to topic are
+// encoded with. readers of topic prefer it for decoding.
+// must be called before sending or reading.
+func (m *pulsarClient) SetTopicCodec(topic string, codec Codec) {
+	m.codecs.byTopic[topic] = codec
+}
+
 // NewReader creates a message reader based on the messenger client
 func (m *pulsarClient) NewReader(
 	from string,
@@ -192,6 +284,13 @@ func (m *pulsarClient) NewReader(
 		stype = pulsar.Shared
 	case FailoverInbox:
 		stype = pulsar.Failover
+	case KeySharedInbox:
+		stype = pulsar.KeyShared
+	}
+	mode := pulsar.Durable
+	if inboxType == TransientInbox {
+		stype = pulsar.Exclusive
+		mode = pulsar.NonDurable
 	}
 	initPosition := pulsar.SubscriptionPositionEarliest
 	if ignorePreviousMessages {
@@ -201,16 +300,23 @@ func (m *pulsarClient) NewReader(
 		Topic:                       from,
 		SubscriptionName:            inboxName,
 		Type:                        stype,
+		SubscriptionMode:            mode,
 		SubscriptionInitialPosition: initPosition,
 		NackRedeliveryDelay:         1 * time.Second,
 	})
 	if err != nil {
 		return nil, err
 	}
-	return &pulsarReader{consumer: consumer}, nil
+	return &pulsarReader{
+		consumer: consumer,
+		topic:    from,
+		codecs:   m.codecs,
+	}, nil
 }
 
-// Close closes client connection
+// Close closes client connection, after
+// publishing the messages still pending
 func (m *pulsarClient) Close() {
+	m.producers.close()
 	m.client.Close()
 }
@@ -0,0 +1,544 @@
+package messenger
+
+import (
+	"cmp"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"slices"
+	"strconv"
+	"sync"
+	"time"
+	"utils/logging"
+)
+
+var (
+	ErrClosed      = errors.New("messenger closed")
+	ErrInboxInUse  = errors.New("inbox already in use")
+	ErrInboxType   = errors.New("inbox has another type")
+	ErrReaderClose = errors.New("reader closed")
+)
+
+// in-process Client, for tests and local development.
+// topics and inboxes are created on demand, like in Pulsar
+// (with auto topic creation), and live until the client
+// is closed.
+type clientRam struct {
+	mutex *sync.Mutex
+	// key: topic
+	topics          map[string]*ramTopic
+	redeliveryDelay time.Duration
+	nextID          uint64
+	closed          bool
+	// see codec.go
+	codecs *codecs
+}
+
+type ramTopic struct {
+	// every message sent, for inboxes that
+	// don't ignore previous messages
+	entries []*ramEntry
+	// key: inbox name
+	inboxes map[string]*ramInbox
+}
+
+type ramInbox struct {
+	inboxType InboxType
+	// messages waiting to be read, in order
+	pending []*ramEntry
+	// attached readers. in a FailoverInbox, only
+	// the first one gets messages.
+	readers []*readerRam
+	// closed (and replaced) whenever pending or readers
+	// change, waking up waiting readers
+	changed chan struct{}
+	// times each message was given back. key: entry id.
+	redeliveries map[uint64]uint32
+}
+
+type ramEntry struct {
+	id          uint64
+	payload     []byte
+	key         string
+	properties  map[string]string
+	eventTime   time.Time
+	publishTime time.Time
+}
+
+type readerRam struct {
+	client *clientRam
+	topic  string
+	name   string
+	inbox  *ramInbox
+	// read but neither acked nor nacked.
+	// key: entry id.
+	unacked map[uint64]*ramEntry
+	closed  bool
+}
+
+type messageRam struct {
+	reader       *readerRam
+	entry        *ramEntry
+	redeliveries uint32
+}
+
+// NewClientRAM creates an in-process messenger client.
+// nacked messages are delivered again after redeliveryDelay.
+func NewClientRAM(redeliveryDelay time.Duration) *clientRam {
+	return &clientRam{
+		mutex:           &sync.Mutex{},
+		topics:          map[string]*ramTopic{},
+		redeliveryDelay: redeliveryDelay,
+		codecs:          newCodecs(),
+	}
+}
+
+// SetCodec sets the codec of topics without their own
+// (see SetTopicCodec). JSONCodec by default.
+// must be called before sending or reading.
+func (c *clientRam) SetCodec(codec Codec) {
+	c.codecs.defaultCodec = codec
+}
+
+// SetTopicCodec sets the codec messages sent to topic are
+// encoded with. readers of topic prefer it for decoding.
+// must be called before sending or reading.
+func (c *clientRam) SetTopicCodec(topic string, codec Codec) {
+	c.codecs.byTopic[topic] = codec
+}
+
+// must be called with mutex held
+func (c *clientRam) topic(name string) *ramTopic {
+	t, ok := c.topics[name]
+	if !ok {
+		t = &ramTopic{
+			inboxes: map[string]*ramInbox{},
+		}
+		c.topics[name] = t
+	}
+	return t
+}
+
+// must be called with mutex held
+func (i *ramInbox) notify() {
+	close(i.changed)
+	i.changed = make(chan struct{})
+}
+
+// Send posts a model based message to every inbox of topic "to"
+func (c *clientRam) Send(to string, model any) error {
+	return c.SendWithOptions(to, model, SendOptions{})
+}
+
+// SendWithOptions posts a model based message with the
+// given attributes to every inbox of topic "to"
+func (c *clientRam) SendWithOptions(
+	to string,
+	model any,
+	opts SendOptions,
+) error {
+	payload, properties, err := c.codecs.encode(to, model, opts.Properties)
+	if err != nil {
+		return fmt.Errorf("failed to encode message: %w", err)
+	}
+
+	opts.Properties = properties
+
+	return c.SendRaw(to, payload, opts)
+}
+
+// SendRaw posts payload as it is, with the given attributes,
+// to every inbox of topic "to". no codec is involved.
+func (c *clientRam) SendRaw(
+	to string,
+	payload []byte,
+	opts SendOptions,
+) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return ErrClosed
+	}
+
+	now := time.Now()
+
+	c.nextID++
+	entry := &ramEntry{
+		id:          c.nextID,
+		payload:     payload,
+		key:         opts.Key,
+		properties:  opts.Properties,
+		eventTime:   opts.EventTime,
+		publishTime: now,
+	}
+
+	t := c.topic(to)
+	t.entries = append(t.entries, entry)
+
+	deliverAt := opts.deliverAt(now)
+
+	for name, inbox := range t.inboxes {
+		delays := inbox.inboxType == SharedInbox ||
+			inbox.inboxType == KeySharedInbox
+		if deliverAt.IsZero() || !delays {
+			inbox.pending = append(inbox.pending, entry)
+			inbox.notify()
+			continue
+		}
+
+		time.AfterFunc(time.Until(deliverAt), func() {
+			c.deliverLater(to, name, inbox, entry)
+		})
+	}
+
+	return nil
+}
+
+// deliverLater puts a delayed entry in inbox, if it still exists
+func (c *clientRam) deliverLater(
+	topic string,
+	name string,
+	inbox *ramInbox,
+	entry *ramEntry,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.hasInbox(topic, name, inbox) {
+		return
+	}
+
+	inbox.pending = append(inbox.pending, entry)
+	inbox.notify()
+}
+
+// reports whether inbox is still the inbox "name" of topic.
+// must be called with mutex held.
+func (c *clientRam) hasInbox(
+	topic string,
+	name string,
+	inbox *ramInbox,
+) bool {
+	t, ok := c.topics[topic]
+	return ok && t.inboxes[name] == inbox
+}
+
+// SendAsync is Send, with the outcome handed to callback
+// from another goroutine, as the Pulsar client does
+func (c *clientRam) SendAsync(
+	to string,
+	model any,
+	callback func(err error),
+) {
+	err := c.Send(to, model)
+	if callback != nil {
+		go callback(err)
+	}
+}
+
+// NewReader attaches a reader to inbox "inboxName" of topic
+// "from", creating the inbox if needed. a new inbox starts
+// at the next message sent if ignorePreviousMessages is set,
+// or at the first one ever sent otherwise.
+func (c *clientRam) NewReader(
+	from string,
+	inboxName string,
+	inboxType InboxType,
+	ignorePreviousMessages bool,
+) (
+	Reader,
+	error,
+) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, ErrClosed
+	}
+
+	t := c.topic(from)
+
+	inbox, ok := t.inboxes[inboxName]
+	if !ok {
+		inbox = &ramInbox{
+			inboxType:    inboxType,
+			changed:      make(chan struct{}),
+			redeliveries: map[uint64]uint32{},
+		}
+		if !ignorePreviousMessages {
+			inbox.pending = append([]*ramEntry(nil), t.entries...)
+		}
+		t.inboxes[inboxName] = inbox
+	}
+
+	if inbox.inboxType != inboxType {
+		return nil, fmt.Errorf("%w: %q", ErrInboxType, inboxName)
+	}
+
+	exclusive := inboxType == ExclusiveInbox ||
+		inboxType == TransientInbox
+	if exclusive && len(inbox.readers) > 0 {
+		return nil, fmt.Errorf("%w: %q", ErrInboxInUse, inboxName)
+	}
+
+	r := &readerRam{
+		client:  c,
+		topic:   from,
+		name:    inboxName,
+		inbox:   inbox,
+		unacked: map[uint64]*ramEntry{},
+	}
+
+	inbox.readers = append(inbox.readers, r)
+	inbox.notify()
+
+	return r, nil
+}
+
+// Close closes every reader and drops every message
+func (c *clientRam) Close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+
+	for _, t := range c.topics {
+		for _, inbox := range t.inboxes {
+			for _, r := range inbox.readers {
+				r.closed = true
+			}
+			inbox.notify()
+		}
+	}
+
+	c.topics = map[string]*ramTopic{}
+}
+
+// next returns the index of the pending message r may read
+// now, or -1 if none. must be called with mutex held.
+func (r *readerRam) next() int {
+	inbox := r.inbox
+
+	switch inbox.inboxType {
+	case FailoverInbox:
+		if inbox.readers[0] != r {
+			return -1
+		}
+	case KeySharedInbox:
+		return slices.IndexFunc(inbox.pending, func(e *ramEntry) bool {
+			return inbox.readerFor(e.key) == r
+		})
+	}
+
+	if len(inbox.pending) == 0 {
+		return -1
+	}
+
+	return 0
+}
+
+// readerFor returns the reader of a KeySharedInbox messages
+// with key go to. it changes as readers join or leave.
+// must be called with mutex held.
+func (i *ramInbox) readerFor(key string) *readerRam {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return i.readers[h.Sum32()%uint32(len(i.readers))]
+}
+
+// Get receives a message, writes its content to a model and mark it as received
+func (r *readerRam) Get(model any, timeout time.Duration) error {
+	msg, err := r.Peek(timeout)
+	if err != nil {
+		return fmt.Errorf("failed to get message: %v", err)
+	}
+	if err := msg.WriteToModel(model); err != nil {
+		return fmt.Errorf("failed to write message to model: %#v", err)
+	}
+	msg.Received()
+	return nil
+}
+
+// Peek receives a message, but doesn't mark it as received
+func (r *readerRam) Peek(
+	timeout time.Duration,
+) (
+	Message,
+	error,
+) {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	for {
+		r.client.mutex.Lock()
+
+		if r.closed {
+			r.client.mutex.Unlock()
+			return nil, ErrReaderClose
+		}
+
+		if i := r.next(); i >= 0 {
+			entry := r.inbox.pending[i]
+			r.inbox.pending = slices.Delete(r.inbox.pending, i, i+1)
+			r.unacked[entry.id] = entry
+
+			msg := &messageRam{
+				reader:       r,
+				entry:        entry,
+				redeliveries: r.inbox.redeliveries[entry.id],
+			}
+			r.client.mutex.Unlock()
+
+			return msg, nil
+		}
+
+		changed := r.inbox.changed
+		r.client.mutex.Unlock()
+
+		select {
+		case <-changed:
+		case <-timer.C:
+			return nil, &TimeoutError{Err: context.DeadlineExceeded}
+		}
+	}
+}
+
+// Close detaches the reader. its unacked messages go back to
+// the inbox. the inbox is removed with its last reader, as the
+// Pulsar reader unsubscribes on close.
+func (r *readerRam) Close(log *logging.Logger) {
+	r.detach(true)
+}
+
+// Disconnect detaches the reader. its unacked messages go
+// back to the inbox, which is kept even without readers.
+func (r *readerRam) Disconnect(log *logging.Logger) {
+	r.detach(false)
+}
+
+func (r *readerRam) detach(unsubscribe bool) {
+	r.client.mutex.Lock()
+	defer r.client.mutex.Unlock()
+
+	if r.closed {
+		return
+	}
+	r.closed = true
+
+	inbox := r.inbox
+
+	for i, other := range inbox.readers {
+		if other == r {
+			inbox.readers = append(inbox.readers[:i], inbox.readers[i+1:]...)
+			break
+		}
+	}
+
+	unacked := make([]*ramEntry, 0, len(r.unacked))
+	for _, entry := range r.unacked {
+		unacked = append(unacked, entry)
+	}
+	slices.SortFunc(unacked, func(a, b *ramEntry) int {
+		return cmp.Compare(a.id, b.id)
+	})
+	inbox.pending = append(unacked, inbox.pending...)
+	r.unacked = map[uint64]*ramEntry{}
+
+	remove := unsubscribe || inbox.inboxType == TransientInbox
+	if remove && len(inbox.readers) == 0 {
+		if t, ok := r.client.topics[r.topic]; ok {
+			delete(t.inboxes, r.name)
+		}
+	}
+
+	inbox.notify()
+}
+
+// WriteToModel writes message's content to a model
+func (m *messageRam) WriteToModel(model any) error {
+	err := m.reader.client.codecs.decode(
+		m.reader.topic, m.entry.properties, m.entry.payload, model)
+	if err != nil {
+		return fmt.Errorf("failed to decode message: %w", err)
+	}
+	return nil
+}
+
+// Payload returns message's payload
+func (m *messageRam) Payload() []byte {
+	return m.entry.payload
+}
+
+// ID returns message's ID
+func (m *messageRam) ID() string {
+	return strconv.FormatUint(m.entry.id, 10)
+}
+
+// Key returns message's key
+func (m *messageRam) Key() string {
+	return m.entry.key
+}
+
+// Properties returns message's properties
+func (m *messageRam) Properties() map[string]string {
+	return m.entry.properties
+}
+
+// EventTime returns message's event time
+func (m *messageRam) EventTime() time.Time {
+	return m.entry.eventTime
+}
+
+// PublishTime returns when message was sent
+func (m *messageRam) PublishTime() time.Time {
+	return m.entry.publishTime
+}
+
+// RedeliveryCount returns how many times message was given back
+func (m *messageRam) RedeliveryCount() uint32 {
+	return m.redeliveries
+}
+
+// Received marks a message as received
+func (m *messageRam) Received() {
+	m.reader.client.mutex.Lock()
+	defer m.reader.client.mutex.Unlock()
+
+	if _, ok := m.reader.unacked[m.entry.id]; !ok {
+		return
+	}
+	delete(m.reader.unacked, m.entry.id)
+	delete(m.reader.inbox.redeliveries, m.entry.id)
+}
+
+// GiveBack gives the message back, so it is delivered
+// again after the client's redelivery delay
+func (m *messageRam) GiveBack() {
+	r := m.reader
+	c := r.client
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if _, ok := r.unacked[m.entry.id]; !ok {
+		// acked, nacked or reader closed
+		return
+	}
+	delete(r.unacked, m.entry.id)
+	r.inbox.redeliveries[m.entry.id]++
+
+	time.AfterFunc(c.redeliveryDelay, func() {
+		c.mutex.Lock()
+		defer c.mutex.Unlock()
+
+		if !c.hasInbox(r.topic, r.name, r.inbox) {
+			// inbox removed meanwhile
+			return
+		}
+
+		r.inbox.pending = append([]*ramEntry{m.entry}, r.inbox.pending...)
+		r.inbox.notify()
+	})
+}
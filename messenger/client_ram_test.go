@@ -0,0 +1,397 @@
+package messenger
+
+import (
+	"errors"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+)
+
+func TestClientRAM(t *testing.T) {
+
+	l := logging.New()
+
+	type model struct {
+		N int
+	}
+
+	// waiting this long means there was no message
+	const short = 20 * time.Millisecond
+
+	get := func(t *testing.T, r Reader) int {
+		t.Helper()
+		m := model{}
+		err := r.Get(&m, time.Second)
+		testutils.AssertError(t, err, nil)
+		return m.N
+	}
+
+	assertEmpty := func(t *testing.T, r Reader) {
+		t.Helper()
+		_, err := r.Peek(short)
+		_, isTimeout := err.(*TimeoutError)
+		testutils.AssertBool(t, isTimeout, true)
+	}
+
+	t.Run("inboxes get their own copy", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r1, err := c.NewReader("topic", "inbox1", ExclusiveInbox, true)
+		testutils.AssertError(t, err, nil)
+		r2, err := c.NewReader("topic", "inbox2", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+		testutils.AssertError(t, c.Send("other", model{N: 2}), nil)
+
+		testutils.AssertInt(t, get(t, r1), 1)
+		testutils.AssertInt(t, get(t, r2), 1)
+		assertEmpty(t, r1)
+		assertEmpty(t, r2)
+	})
+
+	t.Run("previous messages", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+
+		latest, err := c.NewReader("topic", "latest", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+		earliest, err := c.NewReader("topic", "earliest", SharedInbox, false)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 2}), nil)
+
+		testutils.AssertInt(t, get(t, latest), 2)
+		testutils.AssertInt(t, get(t, earliest), 1)
+		testutils.AssertInt(t, get(t, earliest), 2)
+	})
+
+	t.Run("exclusive", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", ExclusiveInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		_, err = c.NewReader("topic", "inbox", ExclusiveInbox, true)
+		testutils.AssertError(t, err, ErrInboxInUse)
+
+		_, err = c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, ErrInboxType)
+
+		r.Close(l)
+
+		_, err = c.NewReader("topic", "inbox", ExclusiveInbox, true)
+		testutils.AssertError(t, err, nil)
+	})
+
+	t.Run("shared", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r1, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+		r2, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		for i := range 4 {
+			testutils.AssertError(t, c.Send("topic", model{N: i}), nil)
+		}
+
+		// each message goes to a single reader
+		got := []int{get(t, r1), get(t, r2), get(t, r1), get(t, r2)}
+		testutils.AssertStruct(t, got, []int{0, 1, 2, 3})
+		assertEmpty(t, r1)
+		assertEmpty(t, r2)
+	})
+
+	t.Run("failover", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		active, err := c.NewReader("topic", "inbox", FailoverInbox, true)
+		testutils.AssertError(t, err, nil)
+		standby, err := c.NewReader("topic", "inbox", FailoverInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+		testutils.AssertError(t, c.Send("topic", model{N: 2}), nil)
+
+		assertEmpty(t, standby)
+
+		// read, not acked
+		msg, err := active.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, string(msg.Payload()), `{"N":1}`)
+
+		active.Close(l)
+
+		// takes over, including the unacked message
+		testutils.AssertInt(t, get(t, standby), 1)
+		testutils.AssertInt(t, get(t, standby), 2)
+
+		// ack through a closed reader does nothing
+		msg.Received()
+		assertEmpty(t, standby)
+	})
+
+	t.Run("key shared", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		readers := []Reader{}
+		for range 2 {
+			r, err := c.NewReader("topic", "inbox", KeySharedInbox, true)
+			testutils.AssertError(t, err, nil)
+			readers = append(readers, r)
+		}
+
+		keys := []string{"a", "b", "c", "d", "e", "f"}
+		for i := range 3 {
+			for _, key := range keys {
+				err := c.SendWithOptions("topic", model{N: i},
+					SendOptions{Key: key})
+				testutils.AssertError(t, err, nil)
+			}
+		}
+
+		// key: message key
+		readerOf := map[string]int{}
+		got := map[string][]int{}
+
+		for ri, r := range readers {
+			for {
+				msg, err := r.Peek(short)
+				if err != nil {
+					break
+				}
+
+				key := msg.Key()
+				if other, ok := readerOf[key]; ok && other != ri {
+					t.Fatalf("key %q read by two readers", key)
+				}
+				readerOf[key] = ri
+
+				m := model{}
+				testutils.AssertError(t, msg.WriteToModel(&m), nil)
+				got[key] = append(got[key], m.N)
+				msg.Received()
+			}
+		}
+
+		used := map[int]bool{}
+		for _, key := range keys {
+			testutils.AssertStruct(t, got[key], []int{0, 1, 2})
+			used[readerOf[key]] = true
+		}
+
+		// keys are spread between readers
+		testutils.AssertInt(t, len(used), 2)
+	})
+
+	t.Run("disconnect keeps inbox", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+
+		// read, not acked
+		_, err = r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+
+		r.Disconnect(l)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 2}), nil)
+
+		r, err = c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertInt(t, get(t, r), 1)
+		testutils.AssertInt(t, get(t, r), 2)
+
+		// unsubscribes
+		r.Close(l)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 3}), nil)
+
+		r, err = c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+		assertEmpty(t, r)
+	})
+
+	t.Run("transient", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", TransientInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		_, err = c.NewReader("topic", "inbox", TransientInbox, true)
+		testutils.AssertError(t, err, ErrInboxInUse)
+
+		// even without unsubscribing, the inbox goes with its reader
+		r.Disconnect(l)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+
+		r, err = c.NewReader("topic", "inbox", TransientInbox, true)
+		testutils.AssertError(t, err, nil)
+		assertEmpty(t, r)
+	})
+
+	t.Run("ack and nack", func(t *testing.T) {
+
+		c := NewClientRAM(50 * time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send("topic", model{N: 1}), nil)
+
+		msg, err := r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+
+		start := time.Now()
+		msg.GiveBack()
+		// twice does nothing
+		msg.GiveBack()
+
+		msg, err = r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertBool(t, time.Since(start) >= 50*time.Millisecond, true)
+		testutils.AssertString(t, string(msg.Payload()), `{"N":1}`)
+
+		msg.Received()
+		assertEmpty(t, r)
+	})
+
+	t.Run("send async", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		done := make(chan error)
+		c.SendAsync("topic", model{N: 1}, func(err error) {
+			done <- err
+		})
+
+		testutils.AssertError(t, <-done, nil)
+		testutils.AssertInt(t, get(t, r), 1)
+	})
+
+	t.Run("options", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		eventTime := time.Date(2025, 9, 10, 10, 0, 0, 0, time.UTC)
+		before := time.Now()
+
+		err = c.SendWithOptions("topic", model{N: 1}, SendOptions{
+			Key:        "customer-1",
+			Properties: map[string]string{"a": "b"},
+			EventTime:  eventTime,
+		})
+		testutils.AssertError(t, err, nil)
+
+		msg, err := r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, msg.Key(), "customer-1")
+		testutils.AssertStruct(t, msg.Properties(), map[string]string{
+			"a":                 "b",
+			ContentTypeProperty: ContentTypeJSON,
+		})
+		testutils.AssertBool(t, msg.EventTime().Equal(eventTime), true)
+		testutils.AssertBool(t, !msg.PublishTime().Before(before), true)
+		testutils.AssertBool(t, msg.ID() != "", true)
+		testutils.AssertInt(t, int(msg.RedeliveryCount()), 0)
+
+		id := msg.ID()
+		msg.GiveBack()
+
+		msg, err = r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, msg.ID(), id)
+		testutils.AssertInt(t, int(msg.RedeliveryCount()), 1)
+	})
+
+	t.Run("delayed delivery", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		shared, err := c.NewReader("topic", "shared", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+		exclusive, err := c.NewReader("topic", "exclusive", ExclusiveInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		err = c.SendWithOptions("topic", model{N: 1}, SendOptions{
+			DeliverAfter: 3 * short,
+		})
+		testutils.AssertError(t, err, nil)
+
+		// as in Pulsar, only shared inboxes delay it
+		testutils.AssertInt(t, get(t, exclusive), 1)
+		assertEmpty(t, shared)
+		testutils.AssertInt(t, get(t, shared), 1)
+	})
+
+	t.Run("waits for messages", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+		defer c.Close()
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		time.AfterFunc(short, func() {
+			c.Send("topic", model{N: 1})
+		})
+
+		testutils.AssertInt(t, get(t, r), 1)
+	})
+
+	t.Run("closed", func(t *testing.T) {
+
+		c := NewClientRAM(time.Millisecond)
+
+		r, err := c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		done := make(chan error)
+		go func() {
+			_, err := r.Peek(time.Minute)
+			done <- err
+		}()
+
+		time.Sleep(short)
+		c.Close()
+
+		testutils.AssertBool(t, errors.Is(<-done, ErrReaderClose), true)
+		testutils.AssertError(t, c.Send("topic", model{}), ErrClosed)
+
+		_, err = c.NewReader("topic", "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, ErrClosed)
+	})
+}
@@ -21,4 +21,17 @@ func TestClient(t *testing.T) {
 		Baba: "bobo",
 	})
 	testutils.AssertError(t, err, nil)
+
+	// same producer, now cached
+	done := make(chan error)
+	pulsar.SendAsync("baba", struct {
+		Baba string
+	}{
+		Baba: "bibi",
+	}, func(err error) {
+		done <- err
+	})
+	testutils.AssertError(t, <-done, nil)
+
+	pulsar.Close()
 }
@@ -0,0 +1,217 @@
+package messenger
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+
+	"github.com/hamba/avro/v2"
+	"google.golang.org/protobuf/proto"
+)
+
+// message property holding the content type of the payload.
+// messages without it are taken as JSON.
+const ContentTypeProperty = "content-type"
+
+const (
+	ContentTypeJSON     = "application/json"
+	ContentTypeProtobuf = "application/x-protobuf"
+	ContentTypeAvro     = "avro/binary"
+	ContentTypeRaw      = "application/octet-stream"
+)
+
+var (
+	ErrUnknownContentType = errors.New("unknown content type")
+	ErrUnsupportedModel   = errors.New("model not supported by codec")
+)
+
+// Codec encodes models into message payloads and back
+type Codec interface {
+	// recorded in the ContentTypeProperty of each
+	// message, so readers know how to decode it
+	ContentType() string
+
+	Encode(model any) ([]byte, error)
+
+	Decode(payload []byte, model any) error
+}
+
+// JSONCodec encodes models as JSON. the default.
+type JSONCodec struct{}
+
+func (JSONCodec) ContentType() string {
+	return ContentTypeJSON
+}
+
+func (JSONCodec) Encode(model any) ([]byte, error) {
+	return json.Marshal(model)
+}
+
+func (JSONCodec) Decode(payload []byte, model any) error {
+	return json.Unmarshal(payload, model)
+}
+
+// ProtobufCodec encodes models implementing proto.Message
+type ProtobufCodec struct{}
+
+func (ProtobufCodec) ContentType() string {
+	return ContentTypeProtobuf
+}
+
+func (ProtobufCodec) Encode(model any) ([]byte, error) {
+	m, ok := model.(proto.Message)
+	if !ok {
+		return nil, fmt.Errorf("%w: %T is not a proto.Message",
+			ErrUnsupportedModel, model)
+	}
+	return proto.Marshal(m)
+}
+
+func (ProtobufCodec) Decode(payload []byte, model any) error {
+	m, ok := model.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T is not a proto.Message",
+			ErrUnsupportedModel, model)
+	}
+	return proto.Unmarshal(payload, m)
+}
+
+// AvroCodec encodes models with an Avro schema. as the schema
+// is not sent along, readers must use a codec with the same
+// (or a compatible) schema for the topic.
+type AvroCodec struct {
+	schema avro.Schema
+}
+
+// NewAvroCodec creates a codec for the given Avro schema (JSON)
+func NewAvroCodec(schema string) (*AvroCodec, error) {
+	s, err := avro.Parse(schema)
+	if err != nil {
+		return nil, fmt.Errorf("parsing avro schema: %w", err)
+	}
+	return &AvroCodec{schema: s}, nil
+}
+
+func (c *AvroCodec) ContentType() string {
+	return ContentTypeAvro
+}
+
+func (c *AvroCodec) Encode(model any) ([]byte, error) {
+	return avro.Marshal(c.schema, model)
+}
+
+func (c *AvroCodec) Decode(payload []byte, model any) error {
+	return avro.Unmarshal(c.schema, payload, model)
+}
+
+// RawCodec sends payloads as they are. models must be
+// []byte or string, or *[]byte when decoding.
+type RawCodec struct{}
+
+func (RawCodec) ContentType() string {
+	return ContentTypeRaw
+}
+
+func (RawCodec) Encode(model any) ([]byte, error) {
+	switch m := model.(type) {
+	case []byte:
+		return m, nil
+	case string:
+		return []byte(m), nil
+	}
+	return nil, fmt.Errorf("%w: %T is not []byte or string",
+		ErrUnsupportedModel, model)
+}
+
+func (RawCodec) Decode(payload []byte, model any) error {
+	m, ok := model.(*[]byte)
+	if !ok {
+		return fmt.Errorf("%w: %T is not *[]byte",
+			ErrUnsupportedModel, model)
+	}
+	*m = append([]byte(nil), payload...)
+	return nil
+}
+
+// codecs picks the codec of each topic
+type codecs struct {
+	defaultCodec Codec
+	// key: topic
+	byTopic map[string]Codec
+}
+
+func newCodecs() *codecs {
+	return &codecs{
+		defaultCodec: JSONCodec{},
+		byTopic:      map[string]Codec{},
+	}
+}
+
+func (c *codecs) forTopic(topic string) Codec {
+	if codec, ok := c.byTopic[topic]; ok {
+		return codec
+	}
+	return c.defaultCodec
+}
+
+// encode encodes model with the codec of topic and returns
+// properties with its content type added
+func (c *codecs) encode(
+	topic string,
+	model any,
+	properties map[string]string,
+) (
+	[]byte,
+	map[string]string,
+	error,
+) {
+	codec := c.forTopic(topic)
+
+	payload, err := codec.Encode(model)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// the caller's map is left untouched
+	out := maps.Clone(properties)
+	if out == nil {
+		out = map[string]string{}
+	}
+	out[ContentTypeProperty] = codec.ContentType()
+
+	return payload, out, nil
+}
+
+// decode decodes a payload read from topic according to
+// its content type. the codec of the topic, or the default
+// one, is preferred when it has that content type, as it may
+// carry a schema.
+func (c *codecs) decode(
+	topic string,
+	properties map[string]string,
+	payload []byte,
+	model any,
+) error {
+	contentType := properties[ContentTypeProperty]
+	if contentType == "" {
+		contentType = ContentTypeJSON
+	}
+
+	for _, codec := range []Codec{c.forTopic(topic), c.defaultCodec} {
+		if codec.ContentType() == contentType {
+			return codec.Decode(payload, model)
+		}
+	}
+
+	switch contentType {
+	case ContentTypeJSON:
+		return JSONCodec{}.Decode(payload, model)
+	case ContentTypeProtobuf:
+		return ProtobufCodec{}.Decode(payload, model)
+	case ContentTypeRaw:
+		return RawCodec{}.Decode(payload, model)
+	}
+
+	return fmt.Errorf("%w: %q", ErrUnknownContentType, contentType)
+}
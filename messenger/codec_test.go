@@ -0,0 +1,123 @@
+package messenger
+
+import (
+	"testing"
+	"time"
+	"utils/utils/testutils"
+
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+func TestCodecs(t *testing.T) {
+
+	type order struct {
+		ID    string `avro:"id" json:"id"`
+		Total int    `avro:"total" json:"total"`
+	}
+
+	avroCodec, err := NewAvroCodec(`{
+		"type": "record",
+		"name": "order",
+		"fields": [
+			{"name": "id", "type": "string"},
+			{"name": "total", "type": "int"}
+		]
+	}`)
+	testutils.AssertError(t, err, nil)
+
+	c := NewClientRAM(time.Millisecond)
+	defer c.Close()
+
+	c.SetTopicCodec("avro", avroCodec)
+	c.SetTopicCodec("proto", ProtobufCodec{})
+	c.SetTopicCodec("raw", RawCodec{})
+
+	// sends model to topic and returns the message read
+	roundTrip := func(t *testing.T, topic string, model any) Message {
+		t.Helper()
+
+		r, err := c.NewReader(topic, "inbox", SharedInbox, true)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, c.Send(topic, model), nil)
+
+		msg, err := r.Peek(time.Second)
+		testutils.AssertError(t, err, nil)
+		msg.Received()
+
+		return msg
+	}
+
+	t.Run("json", func(t *testing.T) {
+
+		msg := roundTrip(t, "json", order{ID: "o1", Total: 10})
+		testutils.AssertString(t,
+			msg.Properties()[ContentTypeProperty], ContentTypeJSON)
+
+		got := order{}
+		testutils.AssertError(t, msg.WriteToModel(&got), nil)
+		testutils.AssertStruct(t, got, order{ID: "o1", Total: 10})
+	})
+
+	t.Run("avro", func(t *testing.T) {
+
+		msg := roundTrip(t, "avro", order{ID: "o1", Total: 10})
+		testutils.AssertString(t,
+			msg.Properties()[ContentTypeProperty], ContentTypeAvro)
+
+		got := order{}
+		testutils.AssertError(t, msg.WriteToModel(&got), nil)
+		testutils.AssertStruct(t, got, order{ID: "o1", Total: 10})
+	})
+
+	t.Run("protobuf", func(t *testing.T) {
+
+		msg := roundTrip(t, "proto", wrapperspb.String("baba"))
+		testutils.AssertString(t,
+			msg.Properties()[ContentTypeProperty], ContentTypeProtobuf)
+
+		got := &wrapperspb.StringValue{}
+		testutils.AssertError(t, msg.WriteToModel(got), nil)
+		testutils.AssertString(t, got.GetValue(), "baba")
+
+		err := c.Send("proto", order{})
+		testutils.AssertError(t, err, ErrUnsupportedModel)
+	})
+
+	t.Run("raw", func(t *testing.T) {
+
+		msg := roundTrip(t, "raw", []byte("bobo"))
+		testutils.AssertString(t, string(msg.Payload()), "bobo")
+
+		got := []byte{}
+		testutils.AssertError(t, msg.WriteToModel(&got), nil)
+		testutils.AssertString(t, string(got), "bobo")
+	})
+
+	t.Run("decoder from content type", func(t *testing.T) {
+
+		// the reader's client knows nothing about the topic
+		other := newCodecs()
+
+		payload, properties, err := c.codecs.encode(
+			"proto", wrapperspb.String("baba"), nil)
+		testutils.AssertError(t, err, nil)
+
+		got := &wrapperspb.StringValue{}
+		err = other.decode("proto", properties, payload, got)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, got.GetValue(), "baba")
+
+		// no schema to decode it
+		payload, properties, err = c.codecs.encode(
+			"avro", order{ID: "o1"}, nil)
+		testutils.AssertError(t, err, nil)
+
+		err = other.decode("avro", properties, payload, &order{})
+		testutils.AssertError(t, err, ErrUnknownContentType)
+
+		// messages from before codecs are JSON
+		err = other.decode("json", nil, []byte(`{"id":"o1"}`), &order{})
+		testutils.AssertError(t, err, nil)
+	})
+}
@@ -10,10 +10,10 @@ import (
 )
 
 type CommonMessage struct {
-	TrackingID       string `json:"tracking_id"`
-	Origin           string `json:"origin"`
-	CreationDateTime string `json:"creation_date_time"`
-	Data             string `json:"data"`
+	TrackingID       string `json:"tracking_id" avro:"tracking_id"`
+	Origin           string `json:"origin" avro:"origin"`
+	CreationDateTime string `json:"creation_date_time" avro:"creation_date_time"`
+	Data             string `json:"data" avro:"data"`
 }
 
 // Publishes a CommonMessage whose "data" field is
@@ -12,6 +12,21 @@ type Message interface {
 
 	Payload() []byte
 
+	// ID identifies the message in the broker
+	ID() string
+
+	Key() string
+
+	Properties() map[string]string
+
+	EventTime() time.Time
+
+	// when the broker received the message
+	PublishTime() time.Time
+
+	// how many times the message was given back
+	RedeliveryCount() uint32
+
 	Received()
 
 	GiveBack()
@@ -30,9 +45,18 @@ type Reader interface {
 		error,
 	)
 
+	// Close unsubscribes and closes the reader. once the
+	// last reader of an inbox unsubscribes, the inbox is
+	// removed along with its pending messages.
 	Close(
 		log *logging.Logger,
 	)
+
+	// Disconnect closes the reader but keeps its inbox,
+	// so messages sent meanwhile wait for the next reader.
+	Disconnect(
+		log *logging.Logger,
+	)
 }
 
 type Client interface {
@@ -51,5 +75,28 @@ type Client interface {
 		model any,
 	) error
 
+	SendWithOptions(
+		to string,
+		model any,
+		opts SendOptions,
+	) error
+
+	// SendRaw sends payload as it is, without encoding it.
+	// opts.Properties are sent as they are, so they should
+	// carry the content type of payload.
+	SendRaw(
+		to string,
+		payload []byte,
+		opts SendOptions,
+	) error
+
+	// SendAsync returns right away. callback, if not nil,
+	// is called with the outcome once it is known.
+	SendAsync(
+		to string,
+		model any,
+		callback func(err error),
+	)
+
 	Close()
 }
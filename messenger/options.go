@@ -0,0 +1,49 @@
+package messenger
+
+import (
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// SendOptions are optional attributes of a sent message.
+// zero values are not set.
+type SendOptions struct {
+	// routes the message to a partition and, in a
+	// KeySharedInbox, to a reader. messages with the same
+	// key go to the same partition and reader.
+	Key string
+	// application defined metadata
+	Properties map[string]string
+	// when the event the message is about happened
+	EventTime time.Time
+	// delays delivery for this long. only honored by
+	// SharedInbox and KeySharedInbox readers, as in Pulsar.
+	DeliverAfter time.Duration
+	// delays delivery until then. same as DeliverAfter.
+	DeliverAt time.Time
+}
+
+func (o *SendOptions) producerMessage(payload []byte) *pulsar.ProducerMessage {
+	return &pulsar.ProducerMessage{
+		Payload:      payload,
+		Key:          o.Key,
+		Properties:   o.Properties,
+		EventTime:    o.EventTime,
+		DeliverAfter: o.DeliverAfter,
+		DeliverAt:    o.DeliverAt,
+	}
+}
+
+// deliverAt returns when a message sent at "now" may be
+// delivered. zero if right away.
+func (o *SendOptions) deliverAt(now time.Time) time.Time {
+	at := o.DeliverAt
+	if o.DeliverAfter > 0 {
+		at = now.Add(o.DeliverAfter)
+	}
+	if !at.After(now) {
+		return time.Time{}
+	}
+	return at
+}
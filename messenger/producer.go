@@ -0,0 +1,325 @@
+package messenger
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// how long a cached producer may stay unused before
+// being closed. see SetProducerIdleTimeout.
+const defaultProducerIdleTimeout = 5 * time.Minute
+
+// BatchingOptions controls how producers group messages
+// before publishing them. zero values keep Pulsar's defaults
+// (10ms, 1000 messages, 128KB).
+type BatchingOptions struct {
+	// send every message on its own
+	Disabled bool
+	// how long a message may wait for its batch to fill up
+	MaxPublishDelay time.Duration
+	MaxMessages     uint
+	// in bytes
+	MaxSize uint
+}
+
+// producerCache keeps one producer per topic, closing
+// the ones left unused for idleTimeout.
+type producerCache struct {
+	// creates producers. called without the mutex held,
+	// as it waits for the broker.
+	create func(pulsar.ProducerOptions) (pulsar.Producer, error)
+	mutex  *sync.Mutex
+	// key: topic
+	producers   map[string]*cachedProducer
+	batching    BatchingOptions
+	idleTimeout time.Duration
+	// closed to stop the eviction goroutine.
+	// nil while it is not running.
+	stop chan struct{}
+	// set by close. no producer is created after it.
+	closed bool
+}
+
+type cachedProducer struct {
+	// closed once producer (or err) is set, by
+	// whoever acquired the topic first
+	ready    chan struct{}
+	producer pulsar.Producer
+	err      error
+	lastUsed time.Time
+	// sends not finished yet. the producer is
+	// not evicted while there are any.
+	inUse int
+}
+
+func newProducerCache(
+	create func(pulsar.ProducerOptions) (pulsar.Producer, error),
+) *producerCache {
+	return &producerCache{
+		create:      create,
+		mutex:       &sync.Mutex{},
+		producers:   map[string]*cachedProducer{},
+		idleTimeout: defaultProducerIdleTimeout,
+	}
+}
+
+// SetBatching sets the batching options of new producers.
+// must be called before the first send.
+func (m *pulsarClient) SetBatching(opts BatchingOptions) {
+	m.producers.mutex.Lock()
+	defer m.producers.mutex.Unlock()
+
+	m.producers.batching = opts
+}
+
+// SetProducerIdleTimeout sets how long a topic's producer is
+// kept open after its last send. must be called before the
+// first send.
+func (m *pulsarClient) SetProducerIdleTimeout(d time.Duration) {
+	m.producers.mutex.Lock()
+	defer m.producers.mutex.Unlock()
+
+	m.producers.idleTimeout = d
+}
+
+// acquire returns the producer of topic "to", creating it if
+// needed. it must be given back with release once the send
+// is finished. concurrent acquires of a topic being created
+// wait for it, without blocking the other topics.
+// returns ErrClosed once the cache is closed.
+func (pc *producerCache) acquire(to string) (*cachedProducer, error) {
+	cp, opts, err := pc.reserve(to)
+	if err != nil {
+		return nil, err
+	}
+	return pc.await(to, cp, opts)
+}
+
+// reserve takes the entry of topic "to", adding it if needed.
+// the caller must then call await, which creates the producer
+// if opts is not nil.
+func (pc *producerCache) reserve(
+	to string,
+) (
+	*cachedProducer,
+	*pulsar.ProducerOptions,
+	error,
+) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	if pc.closed {
+		return nil, nil, ErrClosed
+	}
+
+	cp, ok := pc.producers[to]
+	if !ok {
+		cp = &cachedProducer{ready: make(chan struct{})}
+		pc.producers[to] = cp
+
+		if pc.stop == nil {
+			pc.stop = make(chan struct{})
+			go pc.evict(pc.stop)
+		}
+	}
+
+	// a producer in use, or being created, is not evicted
+	cp.inUse++
+	cp.lastUsed = time.Now()
+
+	if ok {
+		return cp, nil, nil
+	}
+
+	return cp, &pulsar.ProducerOptions{
+		Topic:                   to,
+		DisableBatching:         pc.batching.Disabled,
+		BatchingMaxPublishDelay: pc.batching.MaxPublishDelay,
+		BatchingMaxMessages:     pc.batching.MaxMessages,
+		BatchingMaxSize:         pc.batching.MaxSize,
+		// a batch goes to a single reader of a KeySharedInbox,
+		// so it must not mix keys
+		BatcherBuilderType: pulsar.KeyBasedBatchBuilder,
+	}, nil
+}
+
+// await waits for the producer of cp, reserved for topic "to",
+// creating it first if opts is not nil.
+func (pc *producerCache) await(
+	to string,
+	cp *cachedProducer,
+	opts *pulsar.ProducerOptions,
+) (
+	*cachedProducer,
+	error,
+) {
+	if opts != nil {
+		pc.init(to, cp, *opts)
+	} else {
+		<-cp.ready
+	}
+
+	if cp.err != nil {
+		pc.release(cp)
+		return nil, cp.err
+	}
+
+	return cp, nil
+}
+
+// creates the producer of cp, for topic "to"
+func (pc *producerCache) init(
+	to string,
+	cp *cachedProducer,
+	opts pulsar.ProducerOptions,
+) {
+	defer close(cp.ready)
+
+	producer, err := pc.create(opts)
+	if err != nil {
+		cp.err = fmt.Errorf("failed to create producer: %#v", err)
+
+		// the next acquire tries again
+		pc.mutex.Lock()
+		if pc.producers[to] == cp {
+			delete(pc.producers, to)
+		}
+		pc.mutex.Unlock()
+
+		return
+	}
+
+	cp.producer = producer
+}
+
+func (pc *producerCache) release(cp *cachedProducer) {
+	pc.mutex.Lock()
+	defer pc.mutex.Unlock()
+
+	cp.inUse--
+	cp.lastUsed = time.Now()
+}
+
+// evict periodically closes idle producers until stop is closed
+func (pc *producerCache) evict(stop chan struct{}) {
+	pc.mutex.Lock()
+	ticker := time.NewTicker(max(pc.idleTimeout/2, time.Second))
+	pc.mutex.Unlock()
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+
+		idle := []pulsar.Producer{}
+
+		pc.mutex.Lock()
+		for topic, cp := range pc.producers {
+			if cp.inUse == 0 &&
+				time.Since(cp.lastUsed) >= pc.idleTimeout {
+				idle = append(idle, cp.producer)
+				delete(pc.producers, topic)
+			}
+		}
+		pc.mutex.Unlock()
+
+		// closing flushes, so it is done without the lock
+		for _, p := range idle {
+			p.Close()
+		}
+	}
+}
+
+// close closes every producer, waiting for the ones being
+// created and for pending messages
+func (pc *producerCache) close() {
+	pc.mutex.Lock()
+	producers := pc.producers
+	pc.producers = map[string]*cachedProducer{}
+	pc.closed = true
+	if pc.stop != nil {
+		close(pc.stop)
+		pc.stop = nil
+	}
+	pc.mutex.Unlock()
+
+	for _, cp := range producers {
+		<-cp.ready
+		if cp.producer != nil {
+			cp.producer.Close()
+		}
+	}
+}
+
+// SendAsync posts a model based message to message broker
+// without waiting for it to be published. callback, if not nil,
+// is called with the outcome once it is known; it must not block.
+// messages sent while the producer of the topic is being
+// created may be published in any order.
+func (m *pulsarClient) SendAsync(
+	to string,
+	model any,
+	callback func(err error),
+) {
+	done := func(err error) {
+		if callback != nil {
+			callback(err)
+		}
+	}
+
+	payload, properties, err := m.codecs.encode(to, model, nil)
+	if err != nil {
+		done(fmt.Errorf("failed to encode message: %w", err))
+		return
+	}
+
+	cp, opts, err := m.producers.reserve(to)
+	if err != nil {
+		done(err)
+		return
+	}
+
+	send := func() {
+		cp, err := m.producers.await(to, cp, opts)
+		if err != nil {
+			done(err)
+			return
+		}
+
+		cp.producer.SendAsync(
+			context.Background(),
+			&pulsar.ProducerMessage{
+				Payload:    payload,
+				Properties: properties,
+			},
+			func(_ pulsar.MessageID, _ *pulsar.ProducerMessage, err error) {
+				m.producers.release(cp)
+				if err != nil {
+					err = fmt.Errorf("failed to publish message: %#v", err)
+				}
+				done(err)
+			},
+		)
+	}
+
+	if opts == nil {
+		select {
+		case <-cp.ready:
+			// the usual case: no need to wait
+			send()
+			return
+		default:
+		}
+	}
+
+	// waiting for the broker to create the producer
+	// must not block the caller
+	go send()
+}
@@ -0,0 +1,188 @@
+package messenger
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/utils/testutils"
+
+	"github.com/apache/pulsar-client-go/pulsar"
+)
+
+// fakeProducer only tracks whether it was closed,
+// and publishes everything right away
+type fakeProducer struct {
+	pulsar.Producer
+	closed atomic.Bool
+}
+
+func (p *fakeProducer) Close() {
+	p.closed.Store(true)
+}
+
+func (p *fakeProducer) SendAsync(
+	ctx context.Context,
+	msg *pulsar.ProducerMessage,
+	callback func(pulsar.MessageID, *pulsar.ProducerMessage, error),
+) {
+	callback(nil, msg, nil)
+}
+
+func TestProducerCache(t *testing.T) {
+
+	t.Run("idle eviction", func(t *testing.T) {
+
+		var mutex sync.Mutex
+		created := map[string][]*fakeProducer{}
+
+		pc := newProducerCache(
+			func(opts pulsar.ProducerOptions) (pulsar.Producer, error) {
+				mutex.Lock()
+				defer mutex.Unlock()
+				p := &fakeProducer{}
+				created[opts.Topic] = append(created[opts.Topic], p)
+				return p, nil
+			},
+		)
+		pc.idleTimeout = 10 * time.Millisecond
+		defer pc.close()
+
+		idle, err := pc.acquire("idle")
+		testutils.AssertError(t, err, nil)
+		pc.release(idle)
+
+		busy, err := pc.acquire("busy")
+		testutils.AssertError(t, err, nil)
+
+		// the eviction goroutine ticks every second at least
+		deadline := time.Now().Add(3 * time.Second)
+		for !idle.producer.(*fakeProducer).closed.Load() {
+			if time.Now().After(deadline) {
+				t.Fatal("idle producer not evicted")
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+
+		// in use, so kept
+		testutils.AssertBool(
+			t, busy.producer.(*fakeProducer).closed.Load(), false)
+		pc.release(busy)
+
+		// evicted topics get a new producer
+		again, err := pc.acquire("idle")
+		testutils.AssertError(t, err, nil)
+		pc.release(again)
+
+		mutex.Lock()
+		testutils.AssertInt(t, len(created["idle"]), 2)
+		testutils.AssertInt(t, len(created["busy"]), 1)
+		mutex.Unlock()
+
+	})
+
+	t.Run("creation does not block other topics", func(t *testing.T) {
+
+		unblock := make(chan struct{})
+		var slowCreations atomic.Int32
+
+		pc := newProducerCache(
+			func(opts pulsar.ProducerOptions) (pulsar.Producer, error) {
+				if opts.Topic == "slow" {
+					slowCreations.Add(1)
+					<-unblock
+				}
+				return &fakeProducer{}, nil
+			},
+		)
+		defer pc.close()
+
+		qty := 5
+		slow := make(chan *cachedProducer, qty)
+
+		for range qty {
+			go func() {
+				cp, err := pc.acquire("slow")
+				if err != nil {
+					t.Error(err)
+				}
+				slow <- cp
+			}()
+		}
+
+		for slowCreations.Load() == 0 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// while "slow" is being created
+		fast, err := pc.acquire("fast")
+		testutils.AssertError(t, err, nil)
+		pc.release(fast)
+
+		close(unblock)
+
+		first := <-slow
+		for range qty - 1 {
+			testutils.AssertBool(t, <-slow == first, true)
+		}
+
+		// concurrent acquires share a single creation
+		testutils.AssertInt(t, int(slowCreations.Load()), 1)
+		testutils.AssertInt(t, first.inUse, qty)
+
+	})
+
+	t.Run("send async does not wait for creation", func(t *testing.T) {
+
+		unblock := make(chan struct{})
+
+		m := &pulsarClient{
+			producers: newProducerCache(
+				func(opts pulsar.ProducerOptions) (pulsar.Producer, error) {
+					<-unblock
+					return &fakeProducer{}, nil
+				},
+			),
+			codecs: newCodecs(),
+		}
+		defer m.producers.close()
+
+		sent := make(chan error, 2)
+
+		// would block until unblock is closed otherwise
+		m.SendAsync("topic", 1, func(err error) { sent <- err })
+		m.SendAsync("topic", 2, func(err error) { sent <- err })
+
+		close(unblock)
+
+		for range 2 {
+			testutils.AssertError(t, <-sent, nil)
+		}
+
+	})
+
+	t.Run("closed", func(t *testing.T) {
+
+		pc := newProducerCache(
+			func(opts pulsar.ProducerOptions) (pulsar.Producer, error) {
+				return &fakeProducer{}, nil
+			},
+		)
+
+		cp, err := pc.acquire("topic")
+		testutils.AssertError(t, err, nil)
+		pc.release(cp)
+
+		pc.close()
+		testutils.AssertBool(
+			t, cp.producer.(*fakeProducer).closed.Load(), true)
+
+		_, err = pc.acquire("topic")
+		testutils.AssertError(t, err, ErrClosed)
+
+		// nothing to evict
+		testutils.AssertBool(t, pc.stop == nil, true)
+
+	})
+}
@@ -17,15 +17,62 @@ type Queue struct {
 	periodSeconds int
 	elements      *list.List
 	//processFunc   func(req *Req) bool
-	removedIDs map[string]struct{}
-	requests   chan *Req
-	wait       chan struct{}
+
+	// key: request ID. points to the request's element
+	// in elements (or in its parked list), so lookups and
+	// removals are O(1).
+	index map[string]*list.Element
+
+	// key: request ID. value: copies of it dispatched to a
+	// worker and not yet finished (being processed or waiting
+	// to be retried). an ID pushed again while in flight is
+	// dispatched again, so there may be more than one.
+	inFlight map[string]int
+
+	// key: in flight ID. value: last push sequence number
+	// when it was removed: copies pushed up to then must not
+	// be pushed back again. guarded by mutex.
+	removedIDs map[string]uint64
+	// sequence number of the last push. guarded by mutex.
+	seq      uint64
+	requests chan []*Req
+	wait     chan struct{}
+
+	// metrics. guarded by mutex.
+	// index: worker ID
+	processing []int
+	retries    uint64
+	// failed requests waiting for their retry period
+	waitingRetry int
+	successes    uint64
+	failures     uint64
+	latency      Histogram
+	hook         MetricsHook
+
+	// limits. nil/zero if disabled. see limit.go.
+	limiter   *tokenBucket
+	keyFunc   func(ID string) string
+	maxPerKey int
+	// key: request key. value: requests being processed
+	keyProcessing map[string]int
+	// key: request key. value: requests of a saturated key,
+	// in the order they were found. see limit.go.
+	parked map[string]*list.List
+	// requests in parked lists
+	qtyParked int
 }
 
 // Req refers to a single element (key, value) in elements list.
 type Req struct {
 	ID    string
 	Value string
+
+	// when it entered the queue (or reentered, on retries)
+	enqueuedAt time.Time
+	// push sequence number. see Queue.removedIDs.
+	seq uint64
+	// waiting in a parked list instead of elements
+	parked bool
 }
 
 func New(
@@ -41,32 +88,56 @@ func New(
 		qtyWorkers:    qtyWorkers,
 		elements:      list.New(),
 		//processFunc:   f,
-		requests:   make(chan *Req),
+		index:      make(map[string]*list.Element),
+		inFlight:   make(map[string]int),
+		requests:   make(chan []*Req),
 		wait:       make(chan struct{}, 1),
 		queueID:    queueID,
-		removedIDs: make(map[string]struct{}),
+		removedIDs: make(map[string]uint64),
+		processing: make([]int, qtyWorkers),
+		latency:    newHistogram(LatencyBuckets),
+
+		keyProcessing: make(map[string]int),
+		parked:        make(map[string]*list.List),
 	}
 }
 
+// PushBack adds a request to the end of the queue.
+// if a request with the same ID is already waiting in the
+// queue, its value is replaced and its position is kept.
 func (q *Queue) PushBack(ID string, value string) {
 
 	//l := log.New()
 	q.mutex.Lock()
 	defer q.mutex.Unlock()
 
+	if e, ok := q.index[ID]; ok {
+		e.Value.(*Req).Value = value
+		return
+	}
+
+	q.seq++
+
 	rq := Req{
-		Value: value,
-		ID:    ID,
+		Value:      value,
+		ID:         ID,
+		enqueuedAt: time.Now(),
+		seq:        q.seq,
 	}
 
-	q.elements.PushBack(&rq)
+	q.index[ID] = q.elements.PushBack(&rq)
 
 	//q.wait <- struct{}{}
 
 }
 
+// WakeUp signals an idle dispatcher that there are new
+// elements. it never blocks.
 func (q *Queue) WakeUp() {
-	q.wait <- struct{}{}
+	select {
+	case q.wait <- struct{}{}:
+	default:
+	}
 }
 
 func (q *Queue) Run(
@@ -75,45 +146,110 @@ func (q *Queue) Run(
 		req *Req,
 	) bool,
 ) {
+	q.RunBatch(log, 1, func(reqs []*Req) []bool {
+		return []bool{f(reqs[0])}
+	})
+}
+
+// RunBatch works like Run, but f receives up to batchSize
+// requests at once. f must return one result per request,
+// in the same order: true if that request finished
+// successfully, false if it must be retried later.
+// missing results count as failures.
+func (q *Queue) RunBatch(
+	log *logging.Logger,
+	batchSize int,
+	f func(
+		reqs []*Req,
+	) []bool,
+) {
 
 	l := log.New()
 
+	if batchSize < 1 {
+		batchSize = 1
+	}
+
 	for i := 0; i < q.qtyWorkers; i++ {
 		go q.process(l, i, f)
 	}
 
+	q.mutex.Lock()
+	limiter := q.limiter
+	q.mutex.Unlock()
+
 	for {
 
-		q.mutex.Lock()
-		e := q.elements.Front()
-		q.mutex.Unlock()
-		// if no element, idle wait.
+		max := batchSize
+		if limiter != nil {
+			max = limiter.reserve(batchSize)
+		}
+
+		reqs := q.popFront(max)
+
+		if limiter != nil && len(reqs) < max {
+			limiter.refund(max - len(reqs))
+		}
+
+		// if no element (or none whose key is free), idle wait.
 		// when wait channel receives data (empty struct),
 		// there will be non-nil element in Front.
-		if e == nil {
+		if len(reqs) == 0 {
 			<-q.wait
 			continue
 		}
 
-		// remove from queue but not from persistence.
-		// it will only be removed from persistence if
-		// processFunc returns true. see q.process().
-		// if returns false, element will be readded to queue.
-		q.removeByID(l, e.Value.(*Req).ID)
+		// now sending Front() elements to requests channel.
+		q.requests <- reqs
+
+	}
+
+}
+
+// popFront removes up to max requests from the front of
+// the queue and marks them as in flight.
+// with a key limit, requests whose key is saturated are
+// parked until a request with the same key finishes,
+// so they are not walked over again.
+// they are only removed from persistence if processFunc
+// returns true. see q.process().
+// if returns false, element will be readded to queue.
+func (q *Queue) popFront(max int) []*Req {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	var reqs []*Req
+
+	for len(reqs) < max {
+
+		e := q.elements.Front()
+		if e == nil {
+			break
+		}
+
+		if !q.acquireKey(e.Value.(*Req).ID) {
+			q.park(e)
+			continue
+		}
+
+		req := q.elements.Remove(e).(*Req)
 
-		// now sending Front() element to requests channel.
-		q.requests <- e.Value.(*Req)
+		delete(q.index, req.ID)
+		q.inFlight[req.ID]++
 
+		reqs = append(reqs, req)
 	}
 
+	return reqs
 }
 
 func (q *Queue) process(
 	log *logging.Logger,
 	workerID int,
 	f func(
-		req *Req,
-	) bool,
+		reqs []*Req,
+	) []bool,
 ) {
 
 	l := log.New()
@@ -122,53 +258,115 @@ func (q *Queue) process(
 
 	for {
 
-		// req contains key/value of q.elements' list
-		req := <-q.requests
+		// reqs contains key/values of q.elements' list
+		reqs := <-q.requests
 
-		//l.Info("Worker %v received request %v.", workerID, req.ID)
+		//l.Info("Worker %v received %v requests.", workerID, len(reqs))
+
+		q.mutex.Lock()
+		q.processing[workerID] += len(reqs)
+		q.mutex.Unlock()
 
-		// if returns true, it finished successfully.
+		start := time.Now()
+
+		// if true, it finished successfully.
 		// if false, it did not finish ok. try again later.
+		results := f(reqs)
 
-		// will also check if ID is to be removed.
-		// if it is, will not launch push back again.
-		_, mustRemove := q.removedIDs[req.ID]
+		latency := time.Since(start)
 
-		if mustRemove {
-			delete(q.removedIDs, req.ID)
-		}
+		for i, req := range reqs {
+
+			ok := i < len(results) && results[i]
+
+			hook := q.record(workerID, req.ID, latency, ok)
+			if hook != nil {
+				hook(&Event{
+					QueueID:  q.queueID,
+					WorkerID: workerID,
+					ReqID:    req.ID,
+					Latency:  latency,
+					Success:  ok,
+				})
+			}
 
-		if !f(req) {
+			if ok {
+				q.finish(req)
+				continue
+			}
 
 			//l.Error("Request %v did not complete successfully. Will try again later.",
 			//	req.ID)
 			time.AfterFunc(
 				time.Duration(q.periodSeconds)*time.Second,
 				func() {
-
-					if mustRemove {
-						// will not push back again
-						return
-					}
-
-					q.mutex.Lock()
-					q.elements.PushBack(req)
-					select {
-					case q.wait <- struct{}{}:
-					default:
-					}
-					q.mutex.Unlock()
+					q.retry(req)
 				})
 		}
 	}
 
 }
 
+// finish clears the in flight bookkeeping of req.
+func (q *Queue) finish(req *Req) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.settle(req)
+}
+
+// settle accounts that req is not in flight anymore.
+// must be called with mutex held.
+func (q *Queue) settle(req *Req) {
+
+	q.inFlight[req.ID]--
+	if q.inFlight[req.ID] > 0 {
+		// other copies still need the removal mark
+		return
+	}
+
+	delete(q.inFlight, req.ID)
+	delete(q.removedIDs, req.ID)
+}
+
+// retry pushes req back to the queue, unless it was
+// removed (or pushed again) while it was in flight.
+func (q *Queue) retry(req *Req) {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.waitingRetry--
+
+	removedAt, removed := q.removedIDs[req.ID]
+
+	q.settle(req)
+
+	if removed && req.seq <= removedAt {
+		// will not push back again
+		return
+	}
+
+	if _, ok := q.index[req.ID]; ok {
+		// a newer value was pushed meanwhile
+		return
+	}
+
+	req.enqueuedAt = time.Now()
+	q.index[req.ID] = q.elements.PushBack(req)
+	q.retries++
+
+	select {
+	case q.wait <- struct{}{}:
+	default:
+	}
+}
+
 func (q *Queue) Remove(
 	log *logging.Logger,
 	ID string,
 ) {
-	q.removedIDs[ID] = struct{}{}
 	q.removeByID(log, ID)
 }
 
@@ -183,13 +381,19 @@ func (q *Queue) removeByID(
 	defer q.mutex.Unlock()
 
 	found := false
-	for e := q.elements.Front(); e != nil; e = e.Next() {
-		if e.Value.(*Req).ID == ID {
-			q.elements.Remove(e)
-			found = true
-			//l.Info("removed element with ID %q", ID)
-			break
-		}
+
+	if e, ok := q.index[ID]; ok {
+		q.removeWaiting(e)
+		delete(q.index, ID)
+		//l.Info("removed element with ID %q", ID)
+		found = true
+	}
+
+	// it may also be being processed: make sure no
+	// copy pushed until now will be pushed back.
+	if q.inFlight[ID] > 0 {
+		q.removedIDs[ID] = q.seq
+		found = true
 	}
 
 	if !found {
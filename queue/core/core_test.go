@@ -1,7 +1,10 @@
 package core
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 	"utils/logging"
 	"utils/utils/stringutils"
 	"utils/utils/testutils"
@@ -26,13 +29,13 @@ func TestCore(t *testing.T) {
 		h.PushBack("2", "3")
 
 		testutils.AssertInt(
-			t, h.elements.Len(), 2,
+			t, h.Stats().Depth, 2,
 		)
 
 		h.Remove(l, "1")
 
 		testutils.AssertInt(
-			t, h.elements.Len(), 1,
+			t, h.Stats().Depth, 1,
 		)
 
 	})
@@ -52,9 +55,414 @@ func TestCore(t *testing.T) {
 		h.PushBack("2", "3")
 
 		testutils.AssertInt(
-			t, h.elements.Len(), 2,
+			t, h.Stats().Depth, 2,
 		)
 
 	})
 
+	t.Run("push back same id replaces value", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 1, 5)
+
+		h.PushBack("1", "3")
+		h.PushBack("2", "3")
+		h.PushBack("1", "4")
+
+		testutils.AssertInt(
+			t, h.Stats().Depth, 2,
+		)
+
+		testutils.AssertString(
+			t, h.elements.Front().Value.(*Req).Value, "4",
+		)
+
+	})
+
+	t.Run("remove in flight is not retried", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 1, 1)
+
+		processed := make(chan string, 10)
+
+		go h.Run(l, func(arg *Req) bool {
+			processed <- arg.ID
+			return false
+		})
+
+		h.PushBack("1", "3")
+		h.WakeUp()
+
+		testutils.AssertString(t, <-processed, "1")
+
+		h.Remove(l, "1")
+
+		select {
+		case id := <-processed:
+			t.Fatalf("removed id %v was processed again", id)
+		case <-time.After(2 * time.Second):
+		}
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		testutils.AssertInt(t, len(h.inFlight), 0)
+		testutils.AssertInt(t, len(h.removedIDs), 0)
+
+	})
+
+	t.Run("remove while pushed again in flight", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 2, 1)
+
+		started := make(chan string, 10)
+		// key: value. each copy waits for its result.
+		results := map[string]chan bool{
+			"a": make(chan bool),
+			"b": make(chan bool),
+		}
+
+		go h.Run(l, func(arg *Req) bool {
+			started <- arg.Value
+			return <-results[arg.Value]
+		})
+
+		h.PushBack("1", "a")
+		h.WakeUp()
+		testutils.AssertString(t, <-started, "a")
+
+		// dispatched again while the first copy is processing
+		h.PushBack("1", "b")
+		h.WakeUp()
+		testutils.AssertString(t, <-started, "b")
+
+		// both copies are processing, none waits for retry
+		st := h.Stats()
+		testutils.AssertInt(t, st.InFlight, 2)
+		testutils.AssertInt(t, st.WaitingRetry, 0)
+
+		results["a"] <- true
+
+		inFlight := func() int {
+			h.mutex.Lock()
+			defer h.mutex.Unlock()
+			return h.inFlight["1"]
+		}
+
+		for inFlight() != 1 {
+			time.Sleep(time.Millisecond)
+		}
+
+		// the second copy is still in flight
+		h.Remove(l, "1")
+
+		results["b"] <- false
+
+		select {
+		case v := <-started:
+			t.Fatalf("removed value %v was processed again", v)
+		case <-time.After(2 * time.Second):
+		}
+
+		h.mutex.Lock()
+		defer h.mutex.Unlock()
+
+		testutils.AssertInt(t, len(h.inFlight), 0)
+		testutils.AssertInt(t, len(h.removedIDs), 0)
+
+	})
+
+	t.Run("stats", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 2, 1)
+
+		events := make(chan *Event, 10)
+		h.SetMetricsHook(func(ev *Event) {
+			events <- ev
+		})
+
+		go h.Run(l, func(arg *Req) bool {
+			return arg.ID == "ok"
+		})
+
+		h.PushBack("ok", "3")
+		h.PushBack("fail", "3")
+		h.WakeUp()
+
+		for range 2 {
+			ev := <-events
+			testutils.AssertBool(t, ev.Success, ev.ReqID == "ok")
+		}
+
+		st := h.Stats()
+
+		testutils.AssertInt(t, st.Depth, 0)
+		testutils.AssertInt(t, st.InFlight, 0)
+		testutils.AssertInt(t, len(st.InFlightPerWorker), 2)
+		testutils.AssertInt(t, st.WaitingRetry, 1)
+		testutils.AssertInt(t, int(st.Successes), 1)
+		testutils.AssertInt(t, int(st.Failures), 1)
+		testutils.AssertInt(t, int(st.Latency.Total), 2)
+
+		// failed one is retried after the period
+		ev := <-events
+		testutils.AssertString(t, ev.ReqID, "fail")
+
+		st = h.Stats()
+		testutils.AssertInt(t, int(st.Retries), 1)
+
+	})
+
+	t.Run("batch", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 1, 1)
+
+		batches := make(chan []string, 10)
+
+		go h.RunBatch(l, 2, func(reqs []*Req) []bool {
+			var ids []string
+			var out []bool
+			for _, r := range reqs {
+				ids = append(ids, r.ID)
+				out = append(out, r.ID == "1")
+			}
+			batches <- ids
+			// only "1" succeeds
+			return out
+		})
+
+		h.PushBack("1", "3")
+		h.PushBack("2", "3")
+		h.PushBack("3", "3")
+		h.WakeUp()
+
+		testutils.AssertStruct(t, <-batches, []string{"1", "2"})
+		testutils.AssertStruct(t, <-batches, []string{"3"})
+
+		// "2" and "3" failed: both are retried
+		retried := map[string]bool{}
+		for len(retried) < 2 {
+			for _, id := range <-batches {
+				retried[id] = true
+			}
+		}
+		testutils.AssertStruct(
+			t, retried, map[string]bool{"2": true, "3": true},
+		)
+
+	})
+
+	t.Run("rate limit", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 4, 5)
+		h.SetRateLimit(10, 1)
+
+		done := make(chan struct{}, 10)
+
+		go h.Run(l, func(arg *Req) bool {
+			done <- struct{}{}
+			return true
+		})
+
+		start := time.Now()
+
+		for i := range 5 {
+			h.PushBack(fmt.Sprintf("%d", i), "3")
+		}
+		h.WakeUp()
+
+		for range 5 {
+			<-done
+		}
+
+		// first one uses the burst, the other 4 wait 100ms each
+		testutils.AssertBool(
+			t, time.Since(start) >= 350*time.Millisecond, true,
+		)
+
+	})
+
+	t.Run("key limit", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 4, 5)
+
+		// IDs are "<customer>:<n>"
+		h.SetKeyLimit(func(ID string) string {
+			return ID[:1]
+		}, 1)
+
+		var mutex sync.Mutex
+		processing := map[string]int{}
+		most := 0
+		done := make(chan struct{}, 10)
+
+		go h.Run(l, func(arg *Req) bool {
+			key := arg.ID[:1]
+
+			mutex.Lock()
+			processing[key]++
+			most = max(most, processing[key])
+			mutex.Unlock()
+
+			time.Sleep(20 * time.Millisecond)
+
+			mutex.Lock()
+			processing[key]--
+			mutex.Unlock()
+
+			done <- struct{}{}
+			return true
+		})
+
+		for i := range 3 {
+			h.PushBack(fmt.Sprintf("a:%d", i), "3")
+			h.PushBack(fmt.Sprintf("b:%d", i), "3")
+		}
+		h.WakeUp()
+
+		for range 6 {
+			<-done
+		}
+
+		testutils.AssertInt(t, most, 1)
+		testutils.AssertInt(t, h.Stats().Depth, 0)
+
+	})
+
+	t.Run("key limit parks saturated requests", func(t *testing.T) {
+
+		h := New(stringutils.RandomString(4), 1, 5)
+
+		h.SetKeyLimit(func(ID string) string {
+			return ID[:1]
+		}, 1)
+
+		for _, id := range []string{"a:0", "a:1", "a:2", "b:0"} {
+			h.PushBack(id, "3")
+		}
+
+		ids := func(reqs []*Req) []string {
+			out := []string{}
+			for _, req := range reqs {
+				out = append(out, req.ID)
+			}
+			return out
+		}
+
+		done := func(req *Req) {
+			h.mutex.Lock()
+			h.releaseKey(req.ID)
+			h.mutex.Unlock()
+			h.finish(req)
+		}
+
+		reqs := h.popFront(4)
+		testutils.AssertString(
+			t, fmt.Sprint(ids(reqs)), "[a:0 b:0]")
+		testutils.AssertInt(t, h.Stats().Depth, 2)
+
+		// parked ones can still be removed
+		h.Remove(l, "a:1")
+		testutils.AssertInt(t, h.Stats().Depth, 1)
+
+		done(reqs[0])
+		done(reqs[1])
+
+		reqs = h.popFront(4)
+		testutils.AssertString(t, fmt.Sprint(ids(reqs)), "[a:2]")
+		testutils.AssertInt(t, h.Stats().Depth, 0)
+		testutils.AssertInt(t, len(h.parked), 0)
+
+	})
+
+}
+
+// dispatching the front element must not depend on
+// the backlog size.
+func BenchmarkDispatch(b *testing.B) {
+
+	for _, size := range []int{1_000, 10_000, 100_000} {
+
+		b.Run(fmt.Sprintf("backlog %d", size), func(b *testing.B) {
+
+			h := New(stringutils.RandomString(4), 1, 5)
+
+			for i := range size {
+				h.PushBack(fmt.Sprintf("%d", i), "value")
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				req := h.popFront(1)[0]
+				h.finish(req)
+				h.PushBack(req.ID, req.Value)
+			}
+		})
+	}
+}
+
+// dispatching must not depend on the backlog of a
+// saturated key either.
+func BenchmarkDispatchKeyLimit(b *testing.B) {
+
+	for _, size := range []int{1_000, 10_000, 100_000} {
+
+		b.Run(fmt.Sprintf("backlog %d", size), func(b *testing.B) {
+
+			h := New(stringutils.RandomString(4), 1, 5)
+
+			// IDs are "<customer>:<n>"
+			h.SetKeyLimit(func(ID string) string {
+				return ID[:1]
+			}, 1)
+
+			for i := range size {
+				h.PushBack(fmt.Sprintf("a:%d", i), "value")
+			}
+
+			// saturates "a", parking the rest of its backlog
+			h.popFront(2)
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				h.PushBack(fmt.Sprintf("b:%d", i), "value")
+
+				req := h.popFront(1)[0]
+
+				h.mutex.Lock()
+				h.releaseKey(req.ID)
+				h.mutex.Unlock()
+				h.finish(req)
+			}
+		})
+	}
+}
+
+// removing an element must not depend on the backlog size.
+func BenchmarkRemove(b *testing.B) {
+
+	l := logging.New()
+
+	for _, size := range []int{1_000, 10_000, 100_000} {
+
+		b.Run(fmt.Sprintf("backlog %d", size), func(b *testing.B) {
+
+			h := New(stringutils.RandomString(4), 1, 5)
+
+			for i := range size {
+				h.PushBack(fmt.Sprintf("%d", i), "value")
+			}
+
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				// removes from the middle of the backlog
+				// and pushes it back at the end.
+				id := fmt.Sprintf("%d", i%size)
+				h.Remove(l, id)
+				h.PushBack(id, "value")
+			}
+		})
+	}
 }
@@ -0,0 +1,225 @@
+package core
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+// tokenBucket allows up to rate requests per second,
+// with bursts of up to burst requests.
+type tokenBucket struct {
+	mutex  sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   time.Now(),
+	}
+}
+
+// refill must be called with mutex held.
+func (b *tokenBucket) refill() {
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// reserve blocks until at least one token is available,
+// then takes up to max tokens and returns how many it took.
+func (b *tokenBucket) reserve(max int) int {
+
+	for {
+		b.mutex.Lock()
+		b.refill()
+
+		if b.tokens >= 1 {
+			n := min(max, int(b.tokens))
+			b.tokens -= float64(n)
+			b.mutex.Unlock()
+			return n
+		}
+
+		missing := 1 - b.tokens
+		b.mutex.Unlock()
+
+		time.Sleep(time.Duration(missing / b.rate * float64(time.Second)))
+	}
+}
+
+// refund gives back n tokens that were reserved but not used.
+func (b *tokenBucket) refund(n int) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	b.tokens += float64(n)
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// SetRateLimit limits dispatching to perSecond requests per
+// second, allowing bursts of up to burst requests.
+// perSecond <= 0 disables it. must be called before Run.
+func (q *Queue) SetRateLimit(perSecond float64, burst int) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if perSecond <= 0 {
+		q.limiter = nil
+		return
+	}
+
+	q.limiter = newTokenBucket(perSecond, burst)
+}
+
+// SetKeyLimit allows at most maxPerKey requests being processed
+// at the same time for each key, where keyFunc derives a
+// request's key from its ID (e.g. the customer it refers to).
+// requests whose key is saturated are set aside, in order,
+// and dispatched once a request with the same key finishes.
+// nil keyFunc or maxPerKey < 1 disables it. must be called before Run.
+func (q *Queue) SetKeyLimit(
+	keyFunc func(ID string) string,
+	maxPerKey int,
+) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	if keyFunc == nil || maxPerKey < 1 {
+		q.keyFunc = nil
+		q.maxPerKey = 0
+		return
+	}
+
+	q.keyFunc = keyFunc
+	q.maxPerKey = maxPerKey
+}
+
+// acquireKey takes a processing slot for ID's key.
+// must be called with mutex held.
+func (q *Queue) acquireKey(ID string) bool {
+
+	if q.keyFunc == nil {
+		return true
+	}
+
+	key := q.keyFunc(ID)
+	if q.keyProcessing[key] >= q.maxPerKey {
+		return false
+	}
+
+	q.keyProcessing[key]++
+
+	return true
+}
+
+// releaseKey frees the processing slot of ID's key.
+// must be called with mutex held.
+func (q *Queue) releaseKey(ID string) {
+
+	if q.keyFunc == nil {
+		return
+	}
+
+	key := q.keyFunc(ID)
+
+	q.keyProcessing[key]--
+	if q.keyProcessing[key] <= 0 {
+		delete(q.keyProcessing, key)
+	}
+
+	q.unpark(key)
+
+	// dispatcher may be waiting for this key
+	select {
+	case q.wait <- struct{}{}:
+	default:
+	}
+}
+
+// park moves e, whose key is saturated, from elements to
+// the end of its key's parked list.
+// must be called with mutex held.
+func (q *Queue) park(e *list.Element) {
+
+	req := q.elements.Remove(e).(*Req)
+	req.parked = true
+
+	key := q.keyFunc(req.ID)
+
+	parked, ok := q.parked[key]
+	if !ok {
+		parked = list.New()
+		q.parked[key] = parked
+	}
+
+	q.index[req.ID] = parked.PushBack(req)
+	q.qtyParked++
+}
+
+// unpark moves the first parked request of key, if any, to
+// the front of the queue, as it was there before the ones
+// behind it. must be called with mutex held.
+func (q *Queue) unpark(key string) {
+
+	parked, ok := q.parked[key]
+	if !ok {
+		return
+	}
+
+	req := parked.Remove(parked.Front()).(*Req)
+	req.parked = false
+	q.qtyParked--
+
+	if parked.Len() == 0 {
+		delete(q.parked, key)
+	}
+
+	q.index[req.ID] = q.elements.PushFront(req)
+}
+
+// removeWaiting removes e from elements or from its parked
+// list. must be called with mutex held.
+func (q *Queue) removeWaiting(e *list.Element) {
+
+	req := e.Value.(*Req)
+	if !req.parked {
+		q.elements.Remove(e)
+
+		// it may have been unparked for a free slot of its
+		// key: the next parked one takes its place
+		if q.keyFunc != nil {
+			key := q.keyFunc(req.ID)
+			if q.keyProcessing[key] < q.maxPerKey {
+				q.unpark(key)
+			}
+		}
+
+		return
+	}
+
+	key := q.keyFunc(req.ID)
+	parked := q.parked[key]
+
+	parked.Remove(e)
+	req.parked = false
+	q.qtyParked--
+
+	if parked.Len() == 0 {
+		delete(q.parked, key)
+	}
+}
@@ -0,0 +1,150 @@
+package core
+
+import (
+	"time"
+)
+
+// upper bounds of the processing latency histogram buckets.
+// a last, unbounded bucket counts everything above them.
+var LatencyBuckets = []time.Duration{
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	1 * time.Second,
+	5 * time.Second,
+	10 * time.Second,
+	30 * time.Second,
+}
+
+// Stats is a point in time view of a Queue.
+type Stats struct {
+	QueueID string
+	// requests waiting to be dispatched
+	Depth int
+	// requests being processed right now
+	InFlight int
+	// index: worker ID
+	InFlightPerWorker []int
+	// requests that failed and wait for their retry period
+	WaitingRetry int
+	// age of the request at the front of the queue.
+	// zero if queue is empty.
+	OldestAge time.Duration
+	Retries   uint64
+	Successes uint64
+	Failures  uint64
+	Latency   Histogram
+}
+
+// Histogram counts processing latencies by bucket.
+// Counts[i] holds latencies <= Buckets[i]; the last
+// element of Counts holds the ones above every bucket.
+type Histogram struct {
+	Buckets []time.Duration
+	Counts  []uint64
+	Sum     time.Duration
+	Total   uint64
+}
+
+func newHistogram(buckets []time.Duration) Histogram {
+	return Histogram{
+		Buckets: buckets,
+		Counts:  make([]uint64, len(buckets)+1),
+	}
+}
+
+func (h *Histogram) observe(d time.Duration) {
+	i := 0
+	for i < len(h.Buckets) && d > h.Buckets[i] {
+		i++
+	}
+	h.Counts[i]++
+	h.Sum += d
+	h.Total++
+}
+
+func (h *Histogram) clone() Histogram {
+	out := *h
+	out.Buckets = append([]time.Duration(nil), h.Buckets...)
+	out.Counts = append([]uint64(nil), h.Counts...)
+	return out
+}
+
+// Event describes a single processed request.
+// it is handed to the metrics hook, if any.
+type Event struct {
+	QueueID  string
+	WorkerID int
+	ReqID    string
+	Latency  time.Duration
+	Success  bool
+}
+
+// MetricsHook receives an Event for every processed request.
+// it runs in the worker goroutine, so it must be fast.
+type MetricsHook func(ev *Event)
+
+// SetMetricsHook sets a function to be called after each
+// processed request. nil disables it.
+func (q *Queue) SetMetricsHook(hook MetricsHook) {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.hook = hook
+}
+
+// Stats returns the current state of the queue.
+func (q *Queue) Stats() Stats {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	out := Stats{
+		QueueID:           q.queueID,
+		Depth:             q.elements.Len() + q.qtyParked,
+		InFlightPerWorker: append([]int(nil), q.processing...),
+		WaitingRetry:      q.waitingRetry,
+		Retries:           q.retries,
+		Successes:         q.successes,
+		Failures:          q.failures,
+		Latency:           q.latency.clone(),
+	}
+
+	for _, n := range q.processing {
+		out.InFlight += n
+	}
+
+	if e := q.elements.Front(); e != nil {
+		out.OldestAge = time.Since(e.Value.(*Req).enqueuedAt)
+	}
+
+	return out
+}
+
+// record accounts a processed request and returns
+// the hook to be called, if any.
+func (q *Queue) record(
+	workerID int,
+	ID string,
+	latency time.Duration,
+	success bool,
+) MetricsHook {
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+
+	q.processing[workerID]--
+	q.releaseKey(ID)
+	q.latency.observe(latency)
+
+	if success {
+		q.successes++
+	} else {
+		q.failures++
+		// until retry is called for it
+		q.waitingRetry++
+	}
+
+	return q.hook
+}
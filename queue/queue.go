@@ -3,6 +3,7 @@ package queue
 import (
 	"errors"
 	"utils/logging"
+	"utils/queue/core"
 )
 
 type Handler interface {
@@ -25,4 +26,17 @@ type Handler interface {
 	) error
 }
 
+// Item is a single (ID, value) pair to be queued.
+type Item struct {
+	ID    string
+	Value string
+}
+
+// Stats of a queue handler: the stats of its core queue
+// plus how many entries are persisted for its owner.
+type Stats struct {
+	core.Stats
+	Persisted int
+}
+
 var ErrNullFunc error = errors.New("null function")
@@ -0,0 +1,322 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// how long a worker waits for a message before polling again
+	brokerPeekTimeout = 1 * time.Minute
+
+	// tombstones are forgotten after this long.
+	// older ones are ignored when read again on start.
+	tombstoneTTL = 24 * time.Hour
+)
+
+// queueBroker is a Handler backed by a message broker topic.
+// entries are messages: a failed entry is given back to the
+// broker, which redelivers it after its nack delay.
+//
+// removed IDs are recorded as tombstones and published to
+// a companion topic (topic + "-tombstones"), so every
+// instance consuming from the shared inbox skips them.
+// a tombstone only applies to entries published before it,
+// so an ID pushed again after its removal is processed.
+// until the instance that removed an ID reads its tombstone
+// back, it can't tell that by its own clock, which may be
+// skewed from the broker's: entries with that ID are given
+// back to the broker meanwhile.
+type queueBroker struct {
+	client     messenger.Client
+	topic      string
+	inbox      string
+	qtyWorkers int
+
+	lock *sync.Mutex
+	// key: removed entry ID
+	tombstones map[string]tombstone
+}
+
+type tombstone struct {
+	// when the entry was removed
+	at time.Time
+	// set once the tombstone is read back from the broker:
+	// at is then by the broker's clock
+	confirmed bool
+}
+
+type brokerEntry struct {
+	ID    string `json:"id"`
+	Value string `json:"value,omitempty"`
+}
+
+func NewBroker(
+	client messenger.Client,
+	topic string,
+	inbox string,
+	qtyWorkers int,
+) (
+	*queueBroker,
+	error,
+) {
+
+	if client == nil {
+		return nil, errors.New("null messenger client")
+	}
+
+	if topic == "" {
+		return nil, errors.New("empty topic")
+	}
+
+	if inbox == "" {
+		return nil, errors.New("empty inbox")
+	}
+
+	if qtyWorkers < 1 {
+		return nil, errors.New("invalid qty of workers")
+	}
+
+	return &queueBroker{
+		client:     client,
+		topic:      topic,
+		inbox:      inbox,
+		qtyWorkers: qtyWorkers,
+		lock:       &sync.Mutex{},
+		tombstones: map[string]tombstone{},
+	}, nil
+}
+
+func (h *queueBroker) PushBack(
+	log *logging.Logger,
+	ID string,
+	value string,
+) error {
+
+	l := log.New()
+
+	err := h.client.Send(h.topic, brokerEntry{
+		ID:    ID,
+		Value: value,
+	})
+	if err != nil {
+		return fmt.Errorf("error publishing entry: %w", err)
+	}
+
+	l.Debug("published entry %v to topic %q", ID, h.topic)
+
+	return nil
+}
+
+func (h *queueBroker) Remove(
+	log *logging.Logger,
+	ID string,
+) error {
+
+	l := log.New()
+
+	// effective right away here. confirmed by the broker's
+	// clock once the published tombstone is read back.
+	local := tombstone{at: time.Now()}
+
+	h.lock.Lock()
+	if !h.tombstones[ID].confirmed {
+		h.tombstones[ID] = local
+	}
+	h.lock.Unlock()
+
+	err := h.client.Send(h.tombstoneTopic(), brokerEntry{
+		ID: ID,
+	})
+	if err != nil {
+		// it will never be confirmed
+		h.lock.Lock()
+		if h.tombstones[ID] == local {
+			delete(h.tombstones, ID)
+		}
+		h.lock.Unlock()
+
+		return fmt.Errorf("error publishing tombstone: %w", err)
+	}
+
+	l.Debug("published tombstone for %v", ID)
+
+	return nil
+}
+
+func (h *queueBroker) Run(
+	log *logging.Logger,
+	f func(
+		arg string,
+	) bool,
+) error {
+
+	l := log.New()
+
+	if f == nil {
+		return ErrNullFunc
+	}
+
+	// each instance needs its own copy of every tombstone.
+	// transient, so it doesn't outlive the instance.
+	tombstones, err := h.client.NewReader(
+		h.tombstoneTopic(),
+		h.inbox+"-"+uuid.NewString(),
+		messenger.TransientInbox,
+		false,
+	)
+	if err != nil {
+		return fmt.Errorf("error creating tombstone reader: %w", err)
+	}
+
+	entries, err := h.client.NewReader(
+		h.topic,
+		h.inbox,
+		messenger.SharedInbox,
+		false,
+	)
+	if err != nil {
+		tombstones.Close(l)
+		return fmt.Errorf("error creating reader: %w", err)
+	}
+
+	go h.readTombstones(l, tombstones)
+
+	for i := 0; i < h.qtyWorkers; i++ {
+		go h.process(l, i, entries, f)
+	}
+
+	return nil
+}
+
+func (h *queueBroker) tombstoneTopic() string {
+	return h.topic + "-tombstones"
+}
+
+func (h *queueBroker) readTombstones(
+	log *logging.Logger,
+	reader messenger.Reader,
+) {
+
+	l := log.New()
+
+	for {
+		h.pruneTombstones()
+
+		msg, err := reader.Peek(brokerPeekTimeout)
+		if err != nil {
+			var te *messenger.TimeoutError
+			if !errors.As(err, &te) {
+				l.Error("error getting tombstone: %v", err)
+			}
+			continue
+		}
+
+		entry := brokerEntry{}
+
+		err = msg.WriteToModel(&entry)
+		msg.Received()
+		if err != nil {
+			l.Error("error decoding tombstone: %v", err)
+			continue
+		}
+
+		removedAt := msg.PublishTime()
+		if time.Since(removedAt) > tombstoneTTL {
+			// replayed on start. long expired.
+			continue
+		}
+
+		h.lock.Lock()
+		h.tombstones[entry.ID] = tombstone{
+			at:        removedAt,
+			confirmed: true,
+		}
+		h.lock.Unlock()
+	}
+}
+
+func (h *queueBroker) pruneTombstones() {
+
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	for id, ts := range h.tombstones {
+		if time.Since(ts.at) > tombstoneTTL {
+			delete(h.tombstones, id)
+		}
+	}
+}
+
+func (h *queueBroker) process(
+	log *logging.Logger,
+	workerID int,
+	reader messenger.Reader,
+	f func(
+		arg string,
+	) bool,
+) {
+
+	l := log.New()
+
+	l.SetFrom(fmt.Sprintf("%v-worker:%v", h.topic, workerID))
+
+	for {
+		msg, err := reader.Peek(brokerPeekTimeout)
+		if err != nil {
+			var te *messenger.TimeoutError
+			if !errors.As(err, &te) {
+				l.Error("error getting message: %v", err)
+			}
+			continue
+		}
+
+		entry := brokerEntry{}
+
+		err = msg.WriteToModel(&entry)
+		if err != nil {
+			// will never be decodable. drop it.
+			l.Error("error decoding entry: %v", err)
+			msg.Received()
+			continue
+		}
+
+		// kept until it expires: duplicates of the
+		// removed entry may still come
+		h.lock.Lock()
+		ts, ok := h.tombstones[entry.ID]
+		h.lock.Unlock()
+
+		if ok && !ts.confirmed {
+			// can't tell yet if it was published before
+			// the removal. broker redelivers it later.
+			msg.GiveBack()
+			continue
+		}
+
+		removed := ok && !msg.PublishTime().After(ts.at)
+
+		if removed {
+			l.Info("entry %v was removed. skipping", entry.ID)
+			msg.Received()
+			continue
+		}
+
+		if !f(entry.Value) {
+			// broker redelivers it after its nack delay
+			msg.GiveBack()
+			continue
+		}
+
+		msg.Received()
+
+		l.Info("request %v finished successfully. removed from queue",
+			entry.ID)
+	}
+}
@@ -0,0 +1,159 @@
+package queue
+
+import (
+	"sync"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/messenger"
+	"utils/utils/testutils"
+)
+
+func TestQueueBroker(t *testing.T) {
+
+	l := logging.New()
+
+	// records processed values
+	type recorder struct {
+		mutex *sync.Mutex
+		got   map[string]int
+	}
+
+	newRecorder := func() *recorder {
+		return &recorder{
+			mutex: &sync.Mutex{},
+			got:   map[string]int{},
+		}
+	}
+
+	process := func(r *recorder) func(arg string) bool {
+		return func(arg string) bool {
+			r.mutex.Lock()
+			defer r.mutex.Unlock()
+			r.got[arg]++
+			return true
+		}
+	}
+
+	// waits until every value in want was processed
+	waitFor := func(t *testing.T, r *recorder, want ...string) {
+		t.Helper()
+
+		deadline := time.Now().Add(5 * time.Second)
+		for {
+			r.mutex.Lock()
+			missing := 0
+			for _, w := range want {
+				if r.got[w] == 0 {
+					missing++
+				}
+			}
+			r.mutex.Unlock()
+
+			if missing == 0 {
+				return
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("values not processed: %v", want)
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	hasTombstone := func(h *queueBroker, ID string) bool {
+		h.lock.Lock()
+		defer h.lock.Unlock()
+		return h.tombstones[ID].confirmed
+	}
+
+	t.Run("remove", func(t *testing.T) {
+
+		// not closed: workers never return
+		client := messenger.NewClientRAM(time.Millisecond)
+
+		h, err := NewBroker(client, "remove", "inbox", 2)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, h.PushBack(l, "x", "x1"), nil)
+		// duplicate, also published before the removal
+		testutils.AssertError(t, h.PushBack(l, "x", "x2"), nil)
+		testutils.AssertError(t, h.PushBack(l, "y", "y"), nil)
+		testutils.AssertError(t, h.Remove(l, "x"), nil)
+		testutils.AssertError(t, h.PushBack(l, "x", "x3"), nil)
+
+		r := newRecorder()
+		testutils.AssertError(t, h.Run(l, process(r)), nil)
+
+		waitFor(t, r, "y", "x3")
+		time.Sleep(20 * time.Millisecond)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		testutils.AssertInt(t, r.got["x1"], 0)
+		testutils.AssertInt(t, r.got["x2"], 0)
+		testutils.AssertInt(t, r.got["x3"], 1)
+		testutils.AssertInt(t, r.got["y"], 1)
+	})
+
+	t.Run("local clock behind the broker", func(t *testing.T) {
+
+		client := messenger.NewClientRAM(time.Millisecond)
+
+		h, err := NewBroker(client, "skew", "inbox", 1)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertError(t, h.PushBack(l, "x", "x1"), nil)
+
+		// as Remove does, an hour behind
+		h.tombstones["x"] = tombstone{
+			at: time.Now().Add(-time.Hour),
+		}
+		testutils.AssertError(t, client.Send(
+			h.tombstoneTopic(), brokerEntry{ID: "x"}), nil)
+
+		testutils.AssertError(t, h.PushBack(l, "y", "y"), nil)
+
+		r := newRecorder()
+		testutils.AssertError(t, h.Run(l, process(r)), nil)
+
+		waitFor(t, r, "y")
+		for !hasTombstone(h, "x") {
+			time.Sleep(time.Millisecond)
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		r.mutex.Lock()
+		defer r.mutex.Unlock()
+		testutils.AssertInt(t, r.got["x1"], 0)
+	})
+
+	t.Run("push again on other instances", func(t *testing.T) {
+
+		client := messenger.NewClientRAM(time.Millisecond)
+
+		r := newRecorder()
+
+		instances := []*queueBroker{}
+		for range 2 {
+			h, err := NewBroker(client, "again", "inbox", 1)
+			testutils.AssertError(t, err, nil)
+			testutils.AssertError(t, h.Run(l, process(r)), nil)
+			instances = append(instances, h)
+		}
+
+		testutils.AssertError(t, instances[0].Remove(l, "x"), nil)
+
+		for _, h := range instances {
+			for !hasTombstone(h, "x") {
+				time.Sleep(time.Millisecond)
+			}
+		}
+
+		want := []string{"1", "2", "3", "4", "5", "6"}
+		for _, v := range want {
+			testutils.AssertError(t, instances[0].PushBack(l, "x", v), nil)
+		}
+
+		waitFor(t, r, want...)
+	})
+}
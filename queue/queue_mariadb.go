@@ -4,6 +4,7 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"strings"
 	"time"
 	"utils/logging"
 	"utils/queue/core"
@@ -15,6 +16,10 @@ type queueMariaDB struct {
 	owner string
 }
 
+// max rows per multi-row statement,
+// so placeholders stay below the server limit.
+const maxRowsPerStatement = 1000
+
 type queueEntry struct {
 	ID         int64
 	Owner      string
@@ -88,6 +93,45 @@ func (h *queueMariaDB) PushBack(
 
 }
 
+// PushBatch inserts all items in a single transaction,
+// using multi-row inserts, and then queues them.
+func (h *queueMariaDB) PushBatch(
+	log *logging.Logger,
+	items []Item,
+) error {
+
+	l := log.New()
+
+	if len(items) == 0 {
+		return nil
+	}
+
+	entries := make([]*queueEntry, 0, len(items))
+	for _, item := range items {
+		entries = append(entries, &queueEntry{
+			Owner:      h.owner,
+			ExternalID: item.ID,
+			Data: sql.NullString{
+				String: item.Value,
+				Valid:  true,
+			},
+		})
+	}
+
+	err := h.insertEntries(l, entries)
+	if err != nil {
+		return fmt.Errorf("error inserting entries: %w",
+			err)
+	}
+
+	for _, item := range items {
+		h.coreq.PushBack(item.ID, item.Value)
+	}
+	h.coreq.WakeUp()
+
+	return nil
+}
+
 func (h *queueMariaDB) Remove(
 	log *logging.Logger,
 	id string,
@@ -140,6 +184,84 @@ func (h *queueMariaDB) Run(
 	return nil
 }
 
+// RunBatch works like Run, but f receives the values of up
+// to batchSize entries at once. f must return one result per
+// value, in the same order: successful entries are removed
+// from the queue, the others are retried later.
+func (h *queueMariaDB) RunBatch(
+	log *logging.Logger,
+	batchSize int,
+	f func(
+		args []string,
+	) []bool,
+) error {
+
+	l := log.New()
+
+	if f == nil {
+		return ErrNullFunc
+	}
+
+	go h.coreq.RunBatch(l, batchSize, func(reqs []*core.Req) []bool {
+
+		args := make([]string, 0, len(reqs))
+		for _, req := range reqs {
+			args = append(args, req.Value)
+		}
+
+		results := f(args)
+
+		var doneIDs []string
+		for i, req := range reqs {
+			if i < len(results) && results[i] {
+				doneIDs = append(doneIDs, req.ID)
+			}
+		}
+
+		if len(doneIDs) == 0 {
+			return results
+		}
+
+		err := h.removeEntriesByExternalIDs(
+			l, doneIDs,
+		)
+		if err != nil {
+			l.Error("error removing %v entries: %v",
+				len(doneIDs), err)
+			return nil
+		}
+
+		l.Info("%v requests finished successfully. removed from queue",
+			len(doneIDs))
+
+		return results
+	})
+
+	return nil
+}
+
+// Stats returns the core queue stats and the number of
+// entries persisted for this owner.
+func (h *queueMariaDB) Stats(
+	log *logging.Logger,
+) (
+	*Stats,
+	error,
+) {
+
+	l := log.New()
+
+	persisted, err := h.countEntriesByOwner(l, h.owner)
+	if err != nil {
+		return nil, fmt.Errorf("error counting entries: %w", err)
+	}
+
+	return &Stats{
+		Stats:     h.coreq.Stats(),
+		Persisted: persisted,
+	}, nil
+}
+
 // TODO finalizar a implementação
 func (h *queueMariaDB) List() ([]queueEntry, error) {
 	return nil, nil
@@ -184,6 +306,55 @@ where
 	return nil
 }
 
+func (h *queueMariaDB) removeEntriesByExternalIDs(
+	log *logging.Logger,
+	externalIDs []string,
+) error {
+
+	l := log.New()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning tx: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	for start := 0; start < len(externalIDs); start += maxRowsPerStatement {
+
+		end := min(start+maxRowsPerStatement, len(externalIDs))
+		chunk := externalIDs[start:end]
+
+		cmd := `
+delete from 
+	queue_queue
+where
+	owner = ? and
+	external_id in (?` + strings.Repeat(", ?", len(chunk)-1) + `)
+`
+
+		args := make([]any, 0, len(chunk)+1)
+		args = append(args, h.owner)
+		for _, id := range chunk {
+			args = append(args, id)
+		}
+
+		_, err = tx.Exec(cmd, args...)
+		if err != nil {
+			return fmt.Errorf("error exec: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error commiting tx: %w", err)
+	}
+
+	l.Info("removed %v ids", len(externalIDs))
+
+	return nil
+}
+
 func (h *queueMariaDB) insertEntry(
 	log *logging.Logger,
 	entry *queueEntry,
@@ -236,6 +407,61 @@ values (
 
 }
 
+// inserts all entries in a single transaction,
+// with up to maxRowsPerStatement rows per statement.
+func (h *queueMariaDB) insertEntries(
+	log *logging.Logger,
+	entries []*queueEntry,
+) error {
+
+	l := log.New()
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error beginning tx: %w", err)
+	}
+
+	defer tx.Rollback()
+
+	for start := 0; start < len(entries); start += maxRowsPerStatement {
+
+		end := min(start+maxRowsPerStatement, len(entries))
+		chunk := entries[start:end]
+
+		cmd := `
+insert into	queue_queue(
+	owner, 
+	external_id, 
+	data
+)
+values
+	(?, ?, ?)` + strings.Repeat(",\n\t(?, ?, ?)", len(chunk)-1)
+
+		args := make([]any, 0, 3*len(chunk))
+		for _, entry := range chunk {
+			args = append(args,
+				entry.Owner,
+				entry.ExternalID,
+				entry.Data,
+			)
+		}
+
+		_, err = tx.Exec(cmd, args...)
+		if err != nil {
+			return fmt.Errorf("error exec: %w", err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return fmt.Errorf("error commiting tx: %w", err)
+	}
+
+	l.Info("inserted %v entries", len(entries))
+
+	return nil
+}
+
 func (h *queueMariaDB) getEntriesByOwner(
 	log *logging.Logger,
 	owner string,
@@ -289,6 +515,37 @@ where
 
 }
 
+func (h *queueMariaDB) countEntriesByOwner(
+	log *logging.Logger,
+	owner string,
+) (
+	int,
+	error,
+) {
+
+	l := log.New()
+
+	qry := `
+select 
+	count(*)
+from 
+	queue_queue
+where
+	owner = ?
+`
+
+	var count int
+
+	err := h.db.QueryRow(qry, owner).Scan(&count)
+	if err != nil {
+		return 0, fmt.Errorf("error scanning: %w", err)
+	}
+
+	l.Debug("got qnty entries: %v", count)
+
+	return count, nil
+}
+
 func (h *queueMariaDB) loadEntriesFromOwner(
 	log *logging.Logger,
 ) error {
@@ -137,6 +137,45 @@ func TestQueueMariaDB(t *testing.T) {
 
 	})
 
+	t.Run("push batch", func(t *testing.T) {
+
+		batchOwner := uuid.NewString()
+
+		bh, err := NewMariaDB(
+			db, core.New("test batch", 1, 1), batchOwner,
+		)
+		testutils.AssertBool(t, err == nil, true)
+
+		qty := 5
+		items := make([]Item, 0, qty)
+		for i := range qty {
+			items = append(items, Item{
+				ID:    uuid.NewString(),
+				Value: fmt.Sprintf("test %d", i),
+			})
+		}
+
+		err = bh.PushBatch(l, items)
+		testutils.AssertError(t, err, nil)
+
+		entries, err := bh.getEntriesByOwner(l, batchOwner)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertInt(t, len(entries), qty)
+
+		ids := make([]string, 0, qty)
+		for _, item := range items {
+			ids = append(ids, item.ID)
+		}
+
+		err = bh.removeEntriesByExternalIDs(l, ids)
+		testutils.AssertError(t, err, nil)
+
+		entries, err = bh.getEntriesByOwner(l, batchOwner)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertInt(t, len(entries), 0)
+
+	})
+
 	t.Run("get entries by owner", func(t *testing.T) {
 
 		qty := 3
@@ -0,0 +1,34 @@
+package svcregistry
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/hashicorp/consul/api"
+)
+
+// NewConsulClient creates a Consul API client for the
+// agent at address:port.
+func NewConsulClient(
+	address string,
+	port uint,
+) (
+	*api.Client,
+	error,
+) {
+
+	if len(address) == 0 {
+		return nil, errors.New("empty server address")
+	}
+
+	if port == 0 {
+		return nil, errors.New("invalid server port")
+	}
+
+	return api.NewClient(
+		&api.Config{
+			Address: address + ":" +
+				fmt.Sprintf("%v", port),
+		},
+	)
+}
@@ -2,7 +2,6 @@ package svcregistry
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"strconv"
 	"sync"
@@ -31,18 +30,7 @@ func NewConsulGetter(
 	error,
 ) {
 
-	if len(serverAddress) == 0 {
-		return nil, errors.New("empty server address")
-	}
-
-	if serverPort == 0 {
-		return nil, errors.New("invalid server port")
-	}
-
-	client, err := api.NewClient(&api.Config{
-		Address: serverAddress + ":" +
-			fmt.Sprintf("%v", serverPort),
-	})
+	client, err := NewConsulClient(serverAddress, serverPort)
 	if err != nil {
 		return nil, err
 	}
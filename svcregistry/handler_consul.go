@@ -2,7 +2,6 @@ package svcregistry
 
 import (
 	"context"
-	"errors"
 	"fmt"
 	"time"
 	"utils/logging"
@@ -24,20 +23,7 @@ func NewConsulHandler(
 	error,
 ) {
 
-	if len(consulAddress) == 0 {
-		return nil, errors.New("empty server address")
-	}
-
-	if consulPort == 0 {
-		return nil, errors.New("invalid server port")
-	}
-
-	client, err := api.NewClient(
-		&api.Config{
-			Address: consulAddress + ":" +
-				fmt.Sprintf("%v", consulPort),
-		},
-	)
+	client, err := NewConsulClient(consulAddress, consulPort)
 	if err != nil {
 		return nil, err
 	}
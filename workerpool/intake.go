@@ -0,0 +1,161 @@
+package workerpool
+
+import (
+	"errors"
+	"time"
+)
+
+// OverflowPolicy determines what Feed does when
+// the intake is full.
+type OverflowPolicy int
+
+const (
+	// OverflowBlock waits until there is room
+	OverflowBlock OverflowPolicy = iota
+
+	// OverflowDropNewest silently drops the payload being fed
+	OverflowDropNewest
+
+	// OverflowDropOldest drops the oldest payload waiting in
+	// the intake to make room. without buffer, it works
+	// like OverflowDropNewest.
+	OverflowDropOldest
+
+	// OverflowReject drops the payload being fed and
+	// TryFeed returns ErrFull
+	OverflowReject
+
+	// OverflowBlockTimeout waits until there is room for up
+	// to the feed timeout, then TryFeed returns ErrFeedTimeout
+	OverflowBlockTimeout
+)
+
+var (
+	ErrFull        = errors.New("worker pool intake full")
+	ErrFeedTimeout = errors.New("timeout feeding worker pool")
+)
+
+// IntakeStats are the intake counters of a WorkersPool.
+type IntakeStats struct {
+	// payloads waiting in the intake buffer
+	// (in all of them, when partitioned)
+	Queued   int
+	Capacity int
+	Accepted uint64
+	// dropped by AsyncFeed, OverflowDropNewest and OverflowDropOldest
+	Dropped uint64
+	// rejected by OverflowReject and OverflowBlockTimeout
+	Rejected uint64
+}
+
+// SetIntake makes the intake a buffer of bufferSize payloads and
+// sets what Feed does when it is full. feedTimeout is only used
+// by OverflowBlockTimeout. must be called before Start and Feed.
+func (wp *WorkersPool) SetIntake(
+	bufferSize int,
+	policy OverflowPolicy,
+	feedTimeout time.Duration,
+) {
+	wp.in = make(chan any, max(bufferSize, 0))
+	wp.policy = policy
+	wp.feedTimeout = feedTimeout
+	wp.buildPartitions()
+}
+
+// TryFeed sends payload to the workers according to the
+// overflow policy. returns nil if payload was accepted or
+// silently dropped by policy, ErrFull or ErrFeedTimeout if
+// it was rejected and ErrStopped after Stop.
+func (wp *WorkersPool) TryFeed(payload any) error {
+	wp.feedLock.RLock()
+	defer wp.feedLock.RUnlock()
+
+	// in is only closed after stopping, and not while
+	// the read lock is held: checking first guarantees
+	// the sends below are on an open channel.
+	select {
+	case <-wp.stopping:
+		return ErrStopped
+	default:
+	}
+
+	in := wp.intakeFor(payload)
+
+	if wp.offer(in, payload) {
+		return nil
+	}
+
+	// no room right now
+	switch wp.policy {
+	case OverflowDropNewest:
+		wp.dropped.Add(1)
+		return nil
+
+	case OverflowReject:
+		wp.rejected.Add(1)
+		return ErrFull
+
+	case OverflowDropOldest:
+		for {
+			select {
+			case in <- payload:
+				wp.accepted.Add(1)
+				return nil
+			default:
+			}
+
+			if cap(in) == 0 {
+				wp.dropped.Add(1)
+				return nil
+			}
+
+			// a worker may have taken it meanwhile;
+			// either way there may be room now.
+			select {
+			case <-in:
+				wp.dropped.Add(1)
+			default:
+			}
+		}
+
+	case OverflowBlockTimeout:
+		timer := time.NewTimer(wp.feedTimeout)
+		defer timer.Stop()
+
+		select {
+		case in <- payload:
+			wp.accepted.Add(1)
+			return nil
+		case <-wp.stopping:
+			return ErrStopped
+		case <-timer.C:
+			wp.rejected.Add(1)
+			return ErrFeedTimeout
+		}
+
+	default:
+		select {
+		case in <- payload:
+			wp.accepted.Add(1)
+			return nil
+		case <-wp.stopping:
+			return ErrStopped
+		}
+	}
+}
+
+// IntakeStats returns the current intake counters.
+func (wp *WorkersPool) IntakeStats() IntakeStats {
+	out := IntakeStats{
+		Accepted: wp.accepted.Load(),
+		Dropped:  wp.dropped.Load(),
+		Rejected: wp.rejected.Load(),
+	}
+
+	for _, in := range wp.intakes() {
+		out.Queued += len(in)
+		out.Capacity += cap(in)
+	}
+
+	return out
+}
@@ -0,0 +1,129 @@
+package workerpool
+
+import (
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"sort"
+)
+
+// points each worker gets in the hash ring. more points
+// spread keys more evenly between workers.
+const ringReplicas = 100
+
+var ErrNoWorkers = errors.New("no workers to partition between")
+
+// KeyFunc extracts the partitioning key of a payload.
+type KeyFunc func(payload any) string
+
+// SetPartitioning makes the pool dispatch every payload to a
+// stable worker chosen by its key, through consistent hashing.
+// payloads with the same key are processed in the order they
+// were fed (except one that makes its worker panic); payloads
+// with different keys are still processed in parallel.
+// each worker gets its own intake, sized as set by SetIntake.
+// scaling is not used in this mode. must be called before Start.
+// returns ErrNoWorkers, leaving partitioning off, if the pool
+// was created with no workers.
+func (wp *WorkersPool) SetPartitioning(keyFunc KeyFunc) error {
+
+	if wp.numOfWorkers == 0 {
+		return ErrNoWorkers
+	}
+
+	wp.keyFunc = keyFunc
+	wp.buildPartitions()
+
+	return nil
+}
+
+// buildPartitions creates one intake per worker, with the
+// same capacity as the shared intake.
+func (wp *WorkersPool) buildPartitions() {
+
+	if wp.keyFunc == nil {
+		return
+	}
+
+	wp.partitions = make([]chan any, wp.numOfWorkers)
+	for i := range wp.partitions {
+		wp.partitions[i] = make(chan any, cap(wp.in))
+	}
+
+	wp.ring = newHashRing(int(wp.numOfWorkers), ringReplicas)
+}
+
+// intakeFor returns the intake payload must be sent to.
+func (wp *WorkersPool) intakeFor(payload any) chan any {
+
+	if wp.keyFunc == nil {
+		return wp.in
+	}
+
+	return wp.partitions[wp.ring.get(wp.keyFunc(payload))]
+}
+
+// intakes returns every intake of the pool.
+func (wp *WorkersPool) intakes() []chan any {
+
+	if wp.keyFunc == nil {
+		return []chan any{wp.in}
+	}
+
+	return wp.partitions
+}
+
+// hashRing maps keys to nodes so that changing the number
+// of nodes only remaps a small share of the keys.
+type hashRing struct {
+	// sorted
+	points []uint32
+	// key: point. value: node
+	owners map[uint32]int
+}
+
+func newHashRing(nodes int, replicas int) *hashRing {
+
+	r := &hashRing{
+		owners: make(map[uint32]int, nodes*replicas),
+	}
+
+	for node := 0; node < nodes; node++ {
+		for i := 0; i < replicas; i++ {
+			p := hashKey(fmt.Sprintf("worker-%d#%d", node, i))
+			if _, taken := r.owners[p]; taken {
+				continue
+			}
+			r.owners[p] = node
+			r.points = append(r.points, p)
+		}
+	}
+
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+
+	return r
+}
+
+// get returns the node owning key: the one with the
+// first point clockwise from the key's hash.
+func (r *hashRing) get(key string) int {
+
+	h := hashKey(key)
+
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+
+	return r.owners[r.points[i]]
+}
+
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
@@ -0,0 +1,165 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"utils/logging"
+)
+
+var ErrPanic = errors.New("job panicked")
+
+// Func processes a single job of a Pool.
+type Func[In, Out any] func(
+	ctx context.Context, in In) (Out, error)
+
+// Future is the pending result of a submitted job.
+type Future[Out any] interface {
+	// closed when the result is available
+	Done() <-chan struct{}
+
+	// waits for the result, or until ctx is done.
+	Get(
+		ctx context.Context,
+	) (
+		Out,
+		error,
+	)
+}
+
+// Pool is a typed worker pool: each submitted job is processed
+// by fn in one of its workers and its result (or error)
+// delivered through a Future.
+// it runs on a WorkersPool, so it has the same lifecycle.
+type Pool[In, Out any] struct {
+	wp *WorkersPool
+	fn Func[In, Out]
+}
+
+type job[In, Out any] struct {
+	ctx    context.Context
+	in     In
+	future *future[Out]
+}
+
+type future[Out any] struct {
+	done chan struct{}
+	out  Out
+	err  error
+}
+
+func NewPool[In, Out any](
+	numOfWorkers uint,
+	fn Func[In, Out],
+) *Pool[In, Out] {
+	p := &Pool[In, Out]{
+		fn: fn,
+	}
+	p.wp = New(numOfWorkers, p.work)
+	return p
+}
+
+func (p *Pool[In, Out]) Start(log *logging.Logger) {
+	p.wp.Start(log)
+}
+
+// Submit queues in to be processed, blocking until a worker
+// takes it or ctx is done. ctx is also handed to fn.
+// any error (cancellation, stopped pool, fn's error, panic)
+// is delivered through the returned Future.
+func (p *Pool[In, Out]) Submit(
+	ctx context.Context,
+	in In,
+) Future[Out] {
+
+	j := &job[In, Out]{
+		ctx: ctx,
+		in:  in,
+		future: &future[Out]{
+			done: make(chan struct{}),
+		},
+	}
+
+	err := p.wp.FeedContext(ctx, j)
+	if err != nil {
+		var zero Out
+		j.future.complete(zero, err)
+	}
+
+	return j.future
+}
+
+// Stop stops accepting jobs and waits for the submitted
+// ones to finish. see WorkersPool.Stop.
+func (p *Pool[In, Out]) Stop(ctx context.Context) error {
+	return p.wp.Stop(ctx)
+}
+
+// Wait blocks until every worker has exited.
+func (p *Pool[In, Out]) Wait() {
+	p.wp.Wait()
+}
+
+func (p *Pool[In, Out]) work(
+	log *logging.Logger,
+	id string,
+	in chan any,
+) {
+	for payload := range in {
+		p.execute(log, id, payload.(*job[In, Out]))
+	}
+}
+
+func (p *Pool[In, Out]) execute(
+	log *logging.Logger,
+	id string,
+	j *job[In, Out],
+) {
+
+	var zero Out
+
+	defer func() {
+		if r := recover(); r != nil {
+			l := log.New()
+			l.Error("job panicked in %v: %v\n%s",
+				id, r, debug.Stack())
+			j.future.complete(zero, fmt.Errorf("%w: %v", ErrPanic, r))
+		}
+	}()
+
+	// caller gave up while the job was waiting
+	if err := j.ctx.Err(); err != nil {
+		j.future.complete(zero, err)
+		return
+	}
+
+	out, err := p.fn(j.ctx, j.in)
+
+	j.future.complete(out, err)
+}
+
+func (f *future[Out]) complete(out Out, err error) {
+	f.out = out
+	f.err = err
+	close(f.done)
+}
+
+func (f *future[Out]) Done() <-chan struct{} {
+	return f.done
+}
+
+func (f *future[Out]) Get(
+	ctx context.Context,
+) (
+	Out,
+	error,
+) {
+	select {
+	case <-f.done:
+		return f.out, f.err
+	case <-ctx.Done():
+		var zero Out
+		return zero, ctx.Err()
+	}
+}
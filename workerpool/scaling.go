@@ -0,0 +1,144 @@
+package workerpool
+
+import (
+	"fmt"
+	"time"
+	"utils/logging"
+)
+
+// SetScaling makes the pool size itself between minWorkers and
+// maxWorkers, instead of running numOfWorkers.
+// it is not used with SetPartitioning.
+// a worker is added whenever a feeder finds no room in the intake
+// or at least scaleUpDepth payloads waiting in it; a worker that
+// waits for payloads for idleTimeout is removed, down to minWorkers.
+// with scaling, the worker function is called once per payload
+// (see serve), so it shouldn't keep state across payloads.
+// must be called before Start.
+func (wp *WorkersPool) SetScaling(
+	minWorkers uint,
+	maxWorkers uint,
+	scaleUpDepth int,
+	idleTimeout time.Duration,
+) {
+	wp.scaling = true
+	wp.minWorkers = minWorkers
+	wp.maxWorkers = max(maxWorkers, minWorkers, 1)
+	wp.scaleUpDepth = max(scaleUpDepth, 1)
+	wp.idleTimeout = idleTimeout
+}
+
+// Workers returns how many workers are running.
+func (wp *WorkersPool) Workers() int {
+	return int(wp.current.Load())
+}
+
+// offer sends payload only if there is room right now.
+// with scaling, adds a worker if there is no room or
+// too many payloads are waiting.
+func (wp *WorkersPool) offer(in chan any, payload any) bool {
+	select {
+	case in <- payload:
+		wp.accepted.Add(1)
+		if wp.scaling && len(in) >= wp.scaleUpDepth {
+			wp.scaleUp()
+		}
+		return true
+	default:
+		if wp.scaling {
+			wp.scaleUp()
+		}
+		return false
+	}
+}
+
+// scaleUp adds a worker, unless there are maxWorkers already.
+// must be called with feedLock held for reading, so it never
+// races with Stop.
+func (wp *WorkersPool) scaleUp() {
+	if wp.keyFunc != nil {
+		return
+	}
+
+	for {
+		n := wp.current.Load()
+		if n >= int64(wp.maxWorkers) {
+			return
+		}
+		if wp.current.CompareAndSwap(n, n+1) {
+			break
+		}
+	}
+
+	wp.spawn(wp.log)
+}
+
+// tryRetire removes a worker from the count,
+// unless there are only minWorkers.
+func (wp *WorkersPool) tryRetire() bool {
+	for {
+		n := wp.current.Load()
+		if n <= int64(wp.minWorkers) {
+			return false
+		}
+		if wp.current.CompareAndSwap(n, n-1) {
+			return true
+		}
+	}
+}
+
+// spawn starts a worker that takes payloads from the intake
+// one at a time and can be retired.
+func (wp *WorkersPool) spawn(log *logging.Logger) {
+
+	id := fmt.Sprintf("worker-%v", wp.nextID.Add(1)-1)
+
+	wp.workers.Add(1)
+	go wp.serve(log, id)
+}
+
+// serve runs a scaled worker until the intake is closed or the
+// worker was idle for too long. the worker function is called
+// once per payload, with a channel holding only that payload,
+// so only the time spent waiting for payloads counts as idle.
+func (wp *WorkersPool) serve(
+	log *logging.Logger,
+	id string,
+) {
+
+	defer wp.workers.Done()
+
+	idle := time.NewTimer(wp.idleTimeout)
+	defer idle.Stop()
+
+	for {
+		select {
+		case payload, ok := <-wp.in:
+			if !ok {
+				wp.current.Add(-1)
+				return
+			}
+
+			idle.Stop()
+
+			in := make(chan any, 1)
+			in <- payload
+			close(in)
+
+			// a panic is logged by runOnce and loses
+			// only this payload
+			wp.runOnce(log, id, in)
+
+			idle.Reset(wp.idleTimeout)
+
+		case <-idle.C:
+			if wp.tryRetire() {
+				l := log.New()
+				l.Debug("%v idle for %v. retiring it.",
+					id, wp.idleTimeout)
+				return
+			}
+			idle.Reset(wp.idleTimeout)
+		}
+	}
+}
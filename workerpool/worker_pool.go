@@ -1,10 +1,24 @@
 package workerpool
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
 	"utils/logging"
 )
 
+// how long a panicked worker waits before restarting
+const restartDelay = 1 * time.Second
+
+var ErrStopped = errors.New("worker pool stopped")
+
+// WorkerFunc processes payloads received from in.
+// it must return once in is closed (e.g. by ranging over it),
+// so the pool can be stopped.
 type WorkerFunc func(
 	log *logging.Logger, id string, in chan any)
 
@@ -12,6 +26,35 @@ type WorkersPool struct {
 	numOfWorkers uint
 	in           chan any
 	worker       WorkerFunc
+
+	// held for reading while feeding, and for writing
+	// while closing in, so nobody sends on a closed channel.
+	feedLock *sync.RWMutex
+	stopping chan struct{}
+	stopOnce *sync.Once
+	workers  *sync.WaitGroup
+
+	// intake. see intake.go.
+	policy      OverflowPolicy
+	feedTimeout time.Duration
+	accepted    atomic.Uint64
+	dropped     atomic.Uint64
+	rejected    atomic.Uint64
+
+	// scaling. see scaling.go.
+	log          *logging.Logger
+	scaling      bool
+	minWorkers   uint
+	maxWorkers   uint
+	scaleUpDepth int
+	idleTimeout  time.Duration
+	current      atomic.Int64
+	nextID       atomic.Uint64
+
+	// partitioning. see partition.go.
+	keyFunc    KeyFunc
+	partitions []chan any
+	ring       *hashRing
 }
 
 func New(
@@ -22,25 +65,184 @@ func New(
 		in:           make(chan any),
 		numOfWorkers: numOfWorkers,
 		worker:       worker,
+		feedLock:     &sync.RWMutex{},
+		stopping:     make(chan struct{}),
+		stopOnce:     &sync.Once{},
+		workers:      &sync.WaitGroup{},
 	}
 }
 
 func (wp *WorkersPool) Start(log *logging.Logger) {
+	wp.log = log
+
+	if wp.keyFunc != nil {
+		for i, in := range wp.partitions {
+			id := fmt.Sprintf("worker-%v", i)
+			wp.current.Add(1)
+			wp.workers.Add(1)
+			go wp.run(log, id, in)
+		}
+		return
+	}
+
+	if wp.scaling {
+		for i := 0; i < int(wp.minWorkers); i++ {
+			wp.current.Add(1)
+			wp.spawn(log)
+		}
+		return
+	}
+
 	for i := 0; i < int(wp.numOfWorkers); i++ {
 		id := fmt.Sprintf("worker-%v", i)
-		go wp.worker(log, id, wp.in)
+		wp.current.Add(1)
+		wp.workers.Add(1)
+		go wp.run(log, id, wp.in)
+	}
+}
+
+// run keeps a worker running until it returns normally.
+// if it panics, the panic is logged and the worker restarted,
+// unless the pool is stopping: a worker that doesn't range
+// over in panics on the nil it receives from the closed
+// intake, so it counts as exited.
+func (wp *WorkersPool) run(
+	log *logging.Logger,
+	id string,
+	in chan any,
+) {
+	defer wp.workers.Done()
+	defer wp.current.Add(-1)
+
+	for {
+		if wp.runOnce(log, id, in) {
+			return
+		}
+
+		// a worker that panics right away must not spin
+		select {
+		case <-wp.stopping:
+			return
+		case <-time.After(restartDelay):
+		}
 	}
 }
 
+// runOnce runs the worker and reports whether it returned
+// normally (true) or panicked (false).
+func (wp *WorkersPool) runOnce(
+	log *logging.Logger,
+	id string,
+	in chan any,
+) (returned bool) {
+
+	defer func() {
+		if r := recover(); r != nil {
+			l := log.New()
+			l.Error("worker %v panicked: %v\n%s. restarting it.",
+				id, r, debug.Stack())
+			returned = false
+		}
+	}()
+
+	wp.worker(log, id, in)
+
+	return true
+}
+
+// Feed sends payload to the workers. by default it blocks
+// until there is room in the intake; see SetIntake for other
+// overflow policies. after Stop, payload is dropped.
 func (wp *WorkersPool) Feed(payload any) {
-	wp.in <- payload
+	_ = wp.TryFeed(payload)
 }
 
-func (wp *WorkersPool) AsyncFeed(payload any) bool {
+// FeedContext blocks until there is room in the intake,
+// regardless of the overflow policy, or until ctx is done.
+// returns ErrStopped if the pool is stopped.
+func (wp *WorkersPool) FeedContext(
+	ctx context.Context,
+	payload any,
+) error {
+	wp.feedLock.RLock()
+	defer wp.feedLock.RUnlock()
+
 	select {
-	case wp.in <- payload:
-		return true
+	case <-wp.stopping:
+		return ErrStopped
 	default:
+	}
+
+	in := wp.intakeFor(payload)
+
+	if wp.offer(in, payload) {
+		return nil
+	}
+
+	select {
+	case in <- payload:
+		wp.accepted.Add(1)
+		return nil
+	case <-wp.stopping:
+		return ErrStopped
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// AsyncFeed sends payload only if there is room in the
+// intake right now. returns false if it was dropped.
+func (wp *WorkersPool) AsyncFeed(payload any) bool {
+	wp.feedLock.RLock()
+	defer wp.feedLock.RUnlock()
+
+	select {
+	case <-wp.stopping:
 		return false
+	default:
 	}
+
+	if wp.offer(wp.intakeFor(payload), payload) {
+		return true
+	}
+
+	wp.dropped.Add(1)
+	return false
+}
+
+// Stop closes the intake, so no more payloads are accepted,
+// and waits for the workers to drain it and exit.
+// if ctx is done first, returns its error; workers keep
+// draining in background and Wait can still be used.
+func (wp *WorkersPool) Stop(ctx context.Context) error {
+
+	wp.stopOnce.Do(func() {
+		// releases blocked feeders...
+		close(wp.stopping)
+
+		// ...so the write lock can be taken
+		wp.feedLock.Lock()
+		for _, in := range wp.intakes() {
+			close(in)
+		}
+		wp.feedLock.Unlock()
+	})
+
+	done := make(chan struct{})
+	go func() {
+		wp.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Wait blocks until every started worker has exited.
+func (wp *WorkersPool) Wait() {
+	wp.workers.Wait()
 }
@@ -0,0 +1,428 @@
+package workerpool
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"utils/logging"
+	"utils/utils/testutils"
+)
+
+func TestWorkersPool(t *testing.T) {
+
+	l := logging.New()
+
+	t.Run("stop drains and waits", func(t *testing.T) {
+
+		var processed atomic.Int32
+
+		wp := New(2, func(log *logging.Logger, id string, in chan any) {
+			for range in {
+				time.Sleep(10 * time.Millisecond)
+				processed.Add(1)
+			}
+		})
+		wp.Start(l)
+
+		testutils.AssertInt(t, wp.Workers(), 2)
+
+		for range 10 {
+			wp.Feed(struct{}{})
+		}
+
+		err := wp.Stop(context.Background())
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertInt(t, wp.Workers(), 0)
+
+		// all fed payloads were taken by a worker before
+		// Stop, so all of them were processed
+		testutils.AssertInt(t, int(processed.Load()), 10)
+
+		// no more payloads after stop
+		testutils.AssertBool(t, wp.AsyncFeed(struct{}{}), false)
+		wp.Feed(struct{}{})
+
+	})
+
+	t.Run("stop times out", func(t *testing.T) {
+
+		release := make(chan struct{})
+
+		wp := New(1, func(log *logging.Logger, id string, in chan any) {
+			for range in {
+				<-release
+			}
+		})
+		wp.Start(l)
+
+		wp.Feed(struct{}{})
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 50*time.Millisecond)
+		defer cancel()
+
+		err := wp.Stop(ctx)
+		testutils.AssertError(t, err, context.DeadlineExceeded)
+
+		close(release)
+		wp.Wait()
+
+	})
+
+	t.Run("panic restarts worker", func(t *testing.T) {
+
+		var processed atomic.Int32
+
+		wp := New(1, func(log *logging.Logger, id string, in chan any) {
+			for p := range in {
+				if p == "panic" {
+					panic("boom")
+				}
+				processed.Add(1)
+			}
+		})
+		wp.Start(l)
+
+		wp.Feed("panic")
+		wp.Feed("ok")
+
+		err := wp.Stop(context.Background())
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertInt(t, int(processed.Load()), 1)
+
+	})
+
+	t.Run("panic after stop is not restarted", func(t *testing.T) {
+
+		var processed atomic.Int32
+
+		// never returns: once in is closed, it panics
+		// on the nil it receives
+		wp := New(2, func(log *logging.Logger, id string, in chan any) {
+			for {
+				_ = (<-in).(string)
+				processed.Add(1)
+			}
+		})
+		wp.Start(l)
+
+		wp.Feed("a")
+		wp.Feed("b")
+
+		ctx, cancel := context.WithTimeout(
+			context.Background(), 3*restartDelay)
+		defer cancel()
+
+		err := wp.Stop(ctx)
+		testutils.AssertError(t, err, nil)
+
+		testutils.AssertInt(t, int(processed.Load()), 2)
+
+	})
+}
+
+func TestPool(t *testing.T) {
+
+	l := logging.New()
+
+	ctx := context.Background()
+
+	errOdd := errors.New("odd")
+
+	p := NewPool(2, func(ctx context.Context, in int) (string, error) {
+		if in == 3 {
+			panic("three")
+		}
+		if in%2 == 1 {
+			return "", errOdd
+		}
+		return strconv.Itoa(in), nil
+	})
+	p.Start(l)
+
+	t.Run("result", func(t *testing.T) {
+		out, err := p.Submit(ctx, 2).Get(ctx)
+		testutils.AssertError(t, err, nil)
+		testutils.AssertString(t, out, "2")
+	})
+
+	t.Run("error", func(t *testing.T) {
+		_, err := p.Submit(ctx, 1).Get(ctx)
+		testutils.AssertError(t, err, errOdd)
+	})
+
+	t.Run("panic", func(t *testing.T) {
+		_, err := p.Submit(ctx, 3).Get(ctx)
+		testutils.AssertError(t, err, ErrPanic)
+	})
+
+	t.Run("cancelled", func(t *testing.T) {
+		cctx, cancel := context.WithCancel(ctx)
+		cancel()
+		_, err := p.Submit(cctx, 2).Get(ctx)
+		testutils.AssertError(t, err, context.Canceled)
+	})
+
+	t.Run("stopped", func(t *testing.T) {
+		err := p.Stop(ctx)
+		testutils.AssertError(t, err, nil)
+
+		_, err = p.Submit(ctx, 2).Get(ctx)
+		testutils.AssertError(t, err, ErrStopped)
+	})
+}
+
+func TestIntake(t *testing.T) {
+
+	l := logging.New()
+
+	// returns a started pool whose single worker is busy
+	// with the first payload until release is closed.
+	// processed payloads are sent to out.
+	newBusyPool := func(
+		policy OverflowPolicy,
+	) (
+		wp *WorkersPool,
+		release chan struct{},
+		out chan any,
+	) {
+		release = make(chan struct{})
+		out = make(chan any, 10)
+		busy := make(chan struct{})
+
+		wp = New(1, func(log *logging.Logger, id string, in chan any) {
+			for p := range in {
+				if p == "first" {
+					close(busy)
+					<-release
+				}
+				out <- p
+			}
+		})
+		wp.SetIntake(2, policy, 50*time.Millisecond)
+		wp.Start(l)
+
+		wp.Feed("first")
+		<-busy
+
+		return wp, release, out
+	}
+
+	t.Run("reject", func(t *testing.T) {
+
+		wp, release, _ := newBusyPool(OverflowReject)
+
+		testutils.AssertError(t, wp.TryFeed(1), nil)
+		testutils.AssertError(t, wp.TryFeed(2), nil)
+		testutils.AssertError(t, wp.TryFeed(3), ErrFull)
+
+		st := wp.IntakeStats()
+		testutils.AssertInt(t, st.Queued, 2)
+		testutils.AssertInt(t, st.Capacity, 2)
+		testutils.AssertInt(t, int(st.Accepted), 3)
+		testutils.AssertInt(t, int(st.Rejected), 1)
+
+		close(release)
+		testutils.AssertError(t, wp.Stop(context.Background()), nil)
+
+	})
+
+	t.Run("drop oldest", func(t *testing.T) {
+
+		wp, release, out := newBusyPool(OverflowDropOldest)
+
+		for i := 1; i <= 4; i++ {
+			testutils.AssertError(t, wp.TryFeed(i), nil)
+		}
+
+		close(release)
+		testutils.AssertError(t, wp.Stop(context.Background()), nil)
+		close(out)
+
+		var got []any
+		for p := range out {
+			got = append(got, p)
+		}
+
+		testutils.AssertStruct(t, got, []any{"first", 3, 4})
+		testutils.AssertInt(t, int(wp.IntakeStats().Dropped), 2)
+
+	})
+
+	t.Run("block with timeout", func(t *testing.T) {
+
+		wp, release, _ := newBusyPool(OverflowBlockTimeout)
+
+		testutils.AssertError(t, wp.TryFeed(1), nil)
+		testutils.AssertError(t, wp.TryFeed(2), nil)
+		testutils.AssertError(t, wp.TryFeed(3), ErrFeedTimeout)
+
+		close(release)
+		testutils.AssertError(t, wp.Stop(context.Background()), nil)
+
+	})
+}
+
+func TestScaling(t *testing.T) {
+
+	l := logging.New()
+
+	var processed atomic.Int32
+
+	wp := New(0, func(log *logging.Logger, id string, in chan any) {
+		for range in {
+			time.Sleep(50 * time.Millisecond)
+			processed.Add(1)
+		}
+	})
+	wp.SetScaling(1, 3, 1, 200*time.Millisecond)
+	wp.Start(l)
+
+	testutils.AssertInt(t, wp.Workers(), 1)
+
+	for range 12 {
+		wp.Feed(struct{}{})
+	}
+
+	testutils.AssertInt(t, wp.Workers(), 3)
+
+	// idle workers are retired down to the minimum
+	deadline := time.Now().Add(2 * time.Second)
+	for wp.Workers() > 1 && time.Now().Before(deadline) {
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	testutils.AssertInt(t, wp.Workers(), 1)
+
+	err := wp.Stop(context.Background())
+	testutils.AssertError(t, err, nil)
+
+	testutils.AssertInt(t, wp.Workers(), 0)
+	testutils.AssertInt(t, int(processed.Load()), 12)
+}
+
+func TestScalingBusyWorker(t *testing.T) {
+
+	l := logging.New()
+
+	var running, maxRunning atomic.Int32
+	started := make(chan struct{}, 2)
+
+	// each job takes several idle timeouts
+	wp := New(0, func(log *logging.Logger, id string, in chan any) {
+		for range in {
+			n := running.Add(1)
+			if n > maxRunning.Load() {
+				maxRunning.Store(n)
+			}
+			started <- struct{}{}
+			time.Sleep(100 * time.Millisecond)
+			running.Add(-1)
+		}
+	})
+	wp.SetScaling(0, 1, 1, 20*time.Millisecond)
+	wp.Start(l)
+
+	wp.Feed(struct{}{})
+	<-started
+
+	// busy, not idle
+	time.Sleep(60 * time.Millisecond)
+	testutils.AssertInt(t, wp.Workers(), 1)
+
+	wp.Feed(struct{}{})
+	<-started
+
+	// idle once done
+	deadline := time.Now().Add(2 * time.Second)
+	for wp.Workers() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	testutils.AssertInt(t, wp.Workers(), 0)
+
+	err := wp.Stop(context.Background())
+	testutils.AssertError(t, err, nil)
+
+	testutils.AssertInt(t, int(maxRunning.Load()), 1)
+}
+
+func TestPartitioning(t *testing.T) {
+
+	l := logging.New()
+
+	type msg struct {
+		customer string
+		seq      int
+	}
+
+	var mutex sync.Mutex
+	// key: customer
+	seqs := map[string][]int{}
+	workers := map[string]map[string]bool{}
+
+	wp := New(4, func(log *logging.Logger, id string, in chan any) {
+		for p := range in {
+			m := p.(msg)
+			// uneven work, so unordered dispatch would show
+			time.Sleep(time.Duration(m.seq%3) * time.Millisecond)
+
+			mutex.Lock()
+			seqs[m.customer] = append(seqs[m.customer], m.seq)
+			if workers[m.customer] == nil {
+				workers[m.customer] = map[string]bool{}
+			}
+			workers[m.customer][id] = true
+			mutex.Unlock()
+		}
+	})
+	wp.SetIntake(10, OverflowBlock, 0)
+	err := wp.SetPartitioning(func(payload any) string {
+		return payload.(msg).customer
+	})
+	testutils.AssertError(t, err, nil)
+	wp.Start(l)
+
+	customers := []string{"a", "b", "c", "d", "e", "f"}
+
+	for i := range 20 {
+		for _, c := range customers {
+			wp.Feed(msg{customer: c, seq: i})
+		}
+	}
+
+	err = wp.Stop(context.Background())
+	testutils.AssertError(t, err, nil)
+
+	testutils.AssertInt(t, wp.Workers(), 0)
+
+	for _, c := range customers {
+		testutils.AssertInt(t, len(workers[c]), 1)
+		testutils.AssertInt(t, len(seqs[c]), 20)
+		for i, seq := range seqs[c] {
+			testutils.AssertInt(t, seq, i)
+		}
+	}
+}
+
+func TestPartitioningNoWorkers(t *testing.T) {
+
+	wp := New(0, func(log *logging.Logger, id string, in chan any) {
+		for range in {
+		}
+	})
+
+	err := wp.SetPartitioning(func(payload any) string {
+		return payload.(string)
+	})
+	testutils.AssertError(t, err, ErrNoWorkers)
+
+	// partitioning stays off, so feeding goes to the shared intake
+	testutils.AssertBool(t, wp.keyFunc == nil, true)
+	testutils.AssertBool(t, wp.intakeFor("a") == wp.in, true)
+}